@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"context"
 	"fmt"
 	"log"
 	"pkg"
@@ -10,6 +12,7 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 	"encoding/json"
 	"github.com/qor/render"
@@ -18,10 +21,19 @@ import (
 
 var renderer *render.Render;
 var upgrader = websocket.Upgrader{}
-var hub = &pkg.Hub[pkg.JobStatus]{CommandChSize: 100}
+var hub = &pkg.Hub[pkg.JobStatus]{CommandChSize: 100, MaxLifetime: time.Hour}
+var allJobs = "jobs:all"
 var jobIdRegex = regexp.MustCompile(`jobs/(\d+)`)
+var secretRegex = regexp.MustCompile(`(?i)(password|secret|token)=\S+`)
+var presenceCh = make(chan pkg.PresenceEvent, 100)
 var PublicHost string
 
+// Held by createJob, so two requests for the same job don't both try
+// to claim it
+var createJobLock sync.Mutex
+
+var errJobElsewhere = errors.New("Job is running in another process")
+
 func defaultCtx() map[string]interface{} {
 	ctx := make(map[string]interface{})
 	if pkg.Env == "production" {
@@ -98,6 +110,25 @@ func streamJob(w http.ResponseWriter, r *http.Request) {
 		writeNotFound(w, r)
 		return
 	}
+
+	streamSubscription(w, r, jobStr)
+}
+
+//
+// Every job's messages in one feed. Each envelope's subscription says which
+// job it came from.
+//
+func streamAllJobs(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("streamAllJobs executing\n")
+	streamSubscription(w, r, allJobs)
+}
+
+func streamSubscription(w http.ResponseWriter, r *http.Request, name string) {
+	filter, err := pkg.ParseJobStatusFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	
 	outConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -107,7 +138,7 @@ func streamJob(w http.ResponseWriter, r *http.Request) {
 	}
 	defer outConn.Close()
 
-	cli, err := hub.Subscribe(jobStr)
+	cli, err := hub.SubscribeWithOpts(name, pkg.SubscriberOpts[pkg.JobStatus]{Meta: map[string]string{"remoteAddr": r.RemoteAddr}, Filter: filter})
 	if err != nil {
 		fmt.Printf("Error when subscribing: %s\n", err)
 		return
@@ -115,38 +146,110 @@ func streamJob(w http.ResponseWriter, r *http.Request) {
 
 	for {
 		cli.ClientPing()
-		if m, ok := <- cli.MsgCh; ok {
+		if _, ok := <- cli.MsgCh; ok {
 
-			err := outConn.WriteJSON(m)
+			// Envelope carries the message id, sequence and timestamps alongside the JobStatus
+			err := outConn.WriteJSON(cli.LastEnvelope())
 			if err != nil {
 				fmt.Printf("Unable to write message: %s\n", err)
 				// this is how we detect that client closed at this time lol.
 				cli.Close()
-				removeCmd := pkg.HubCommand[pkg.JobStatus]{CmdType: pkg.HubCmdRemoveSubscriber, Subscription: jobStr, SubscriberId: cli.Id}
+				removeCmd := pkg.HubCommand[pkg.JobStatus]{CmdType: pkg.HubCmdRemoveSubscriber, Subscription: name, SubscriberId: cli.Id}
 				select {
 				case hub.CommandCh <- removeCmd:
 					break
 				default:
 				}
+				return
 			}
-			// fmt.Printf("Wrote a message: %s", m)
+			// fmt.Printf("Wrote a message: %v", cli.LastEnvelope())
 		} else {
 			// Subscription was closed
 			break
 		}			
 	}
+
+	code, text := closeFrame(cli.Reason())
+	err = outConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+	if err != nil {
+		fmt.Printf("Unable to write close message: %s\n", err)
+	}
 }
 
-func runJob(jobId int) {
+//
+// Websocket close code and text telling the browser why its stream ended.
+// 4000-4999 are free for application use.
+//
+func closeFrame(reason pkg.CloseReason) (int, string) {
+	switch reason {
+	case pkg.CloseFailed:
+		return websocket.CloseInternalServerErr, "Job failed"
+	case pkg.CloseCancelled:
+		return 4000, "Job was cancelled"
+	case pkg.CloseReaped:
+		return 4001, "Job expired"
+	case pkg.CloseShutdown:
+		return websocket.CloseGoingAway, "Server is shutting down"
+	default:
+		return websocket.CloseNormalClosure, "Job finished"
+	}
+}
+
+//
+// Claims the job and creates its subscription, so the job page finds it
+// right away. Another server instance may already be running the job, in
+// which case errJobElsewhere is returned. The claim is nil on systems
+// without file locks.
+//
+func startJob(jobId int, owner string) (*pkg.FileLock, error) {
 	jobStr := "job:" + strconv.Itoa(jobId)
 
-	_, err := hub.CreateSubscription(jobStr)
+	claim := &pkg.FileLock{Dir: os.Getenv("LOCK_DIR"), Name: fmt.Sprintf("job-%d.lock", jobId)}
+	claim.Init()
+	claimed, err := claim.TryLockForWriting()
+	if errors.Is(err, pkg.ErrFileLocksUnsupported) {
+		// Nothing to coordinate with, so run it here
+		fmt.Printf("Running %s without a claim: %s\n", jobStr, err)
+		claim = nil
+	} else if err != nil {
+		return nil, err
+	} else if !claimed {
+		return nil, errJobElsewhere
+	}
+	if claim != nil && claim.StalePid != 0 {
+		fmt.Printf("Taking over %s from crashed process %d\n", jobStr, claim.StalePid)
+	}
+
+	opts := pkg.SubscriptionOpts[pkg.JobStatus]{Owner: owner, Labels: map[string]string{"kind": "job"}, IdleTTL: 30 * time.Second}
+
+	// Slow clients only need the latest percentage
+	opts.Conflate = func(status pkg.JobStatus) string {
+		if status.Type == "complete" {
+			return status.Type
+		}
+		return ""
+	}
+
+	_, err = hub.CreateSubscriptionWithOpts(jobStr, opts)
 	if err != nil {
-		fmt.Printf("Unable to create subscription: %s\n", err)
-		return
+		if claim != nil {
+			claim.WritingUnlock()
+		}
+		return nil, err
 	}
 
 	fmt.Printf("Created subscription: %s\n", jobStr)
+	return claim, nil
+}
+
+//
+// Publishes the job's progress and output, then releases its claim.
+//
+func runJob(jobId int, claim *pkg.FileLock) {
+	jobStr := "job:" + strconv.Itoa(jobId)
+	if claim != nil {
+		defer claim.WritingUnlock()
+	}
 
 	pause, err := time.ParseDuration("500ms")
 	if err != nil {
@@ -155,13 +258,76 @@ func runJob(jobId int) {
 
 	for i := 1; i <= 15; i++ {
 		time.Sleep(pause)
-		hub.PublishTo(jobStr, pkg.JobStatus{Type: "complete", Complete: float64(i)/15.0})
-		hub.PublishTo(jobStr, pkg.JobStatus{Type: "message", Message: fmt.Sprintf("Part %d\n", i)})
+
+		// A newer percentage makes a dropped one moot, but the last one
+		// is what late watchers see, so it waits
+		progress := pkg.JobStatus{Type: "complete", Complete: float64(i)/15.0}
+		if i < 15 {
+			err = hub.TryPublishRetained(jobStr, "complete", progress)
+		} else {
+			err = hub.PublishRetained(jobStr, "complete", progress)
+		}
+		if err != nil {
+			fmt.Printf("Dropped progress for %s: %s\n", jobStr, err)
+		}
+
+		// Output lines are ordered and each one matters, so they wait
+		err = hub.PublishTo(jobStr, pkg.JobStatus{Type: "message", Message: fmt.Sprintf("Part %d\n", i)})
+		if err != nil {
+			fmt.Printf("Unable to publish to %s, stopping: %s\n", jobStr, err)
+			return
+		}
 	}
-	
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	report, err := hub.PublishSync(ctx, jobStr, pkg.JobStatus{Type: "message", Message: "Done.\n"})
+	cancel()
+	if err != nil {
+		fmt.Printf("Unable to publish final message: %s\n", err)
+	} else {
+		fmt.Printf("Final message for %s reached %d, dead %d, timed out %d, dropped %d\n", jobStr, report.Reached, report.Dead, report.TimedOut, report.Dropped)
+	}
+
 	hub.RemoveSubscription(jobStr)
 }
 
+//
+// Keeps credentials in job output from reaching browsers.
+//
+func redactSecrets(name string, status pkg.JobStatus) (pkg.JobStatus, error) {
+	status.Message = secretRegex.ReplaceAllString(status.Message, "$1=[REDACTED]")
+	return status, nil
+}
+
+//
+// Tells a job's watchers how many of them there are. Leave events come
+// from the hub's Listen(), so this only queues the event for
+// publishPresence and never blocks.
+//
+func announcePresence(event pkg.PresenceEvent) {
+	if !strings.HasPrefix(event.Subscription, "job:") {
+		return
+	}
+
+	select {
+	case presenceCh <- event:
+	default:
+		fmt.Printf("Dropped presence event for %s\n", event.Subscription)
+	}
+}
+
+//
+// Publishes presence counts one at a time, so watchers see them in the
+// order they happened. They're quiet so that watchers coming and going
+// doesn't keep a dead job from being reaped.
+//
+func publishPresence() {
+	for event := range presenceCh {
+		// Subscription may be gone by the time a leave event is published
+		hub.PublishWithOpts(event.Subscription, pkg.JobStatus{Type: "presence", Watchers: event.Count}, pkg.PublishOpts{Quiet: true})
+	}
+}
+
 func createJob(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeInteralServerError(w, r, "Method not supported at this URL")
@@ -180,12 +346,24 @@ func createJob(w http.ResponseWriter, r *http.Request) {
 	}
 
 	id := strconv.Itoa(jobId)
+	createJobLock.Lock()
+	defer createJobLock.Unlock()
 	if sub := hub.GetSubscription("job:" + id); sub != nil {
 		http.Redirect(w, r, r.URL.Host + "/jobs/" + id, 302)
 		return
 	}
 
-	go runJob(jobId)
+	// The job page only works on the instance running the job
+	claim, err := startJob(jobId, r.RemoteAddr)
+	if errors.Is(err, errJobElsewhere) {
+		writeError(w, fmt.Sprintf("Job %s is already running on another server", id), http.StatusConflict)
+		return
+	} else if err != nil {
+		writeInteralServerError(w, r, fmt.Sprintf("Unable to start job %s: %s", id, err))
+		return
+	}
+
+	go runJob(jobId, claim)
 
 	http.Redirect(w, r, r.URL.Host + "/jobs/" + id, 302)
 }
@@ -206,14 +384,51 @@ func subscriptions(w http.ResponseWriter, r *http.Request) {
 	renderer.Execute("subscriptions", ctx, r, w)
 }
 
+//
+// Hub lock contention stats as JSON. Only available when the server
+// runs with LOCK_STATS=true.
+//
+func metrics(w http.ResponseWriter, r *http.Request) {
+	lock, ok := hub.Lock.(*pkg.ReadWriteLock)
+	if !ok {
+		writeNotFound(w, r)
+		return
+	}
+
+	stats, ok := lock.Stats()
+	if !ok {
+		writeNotFound(w, r)
+		return
+	}
+
+	bytes, err := json.Marshal(map[string]interface{}{"hubLock": stats})
+	if err != nil {
+		fmt.Printf("Error when marshaling lock stats: %s\n", err)
+		writeInteralServerError(w, r, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
 func main() {
 	fmt.Printf("Starting web server...\n")
 
 	pkg.Init()
 	fmt.Printf("Web server loading for env %s...\n", pkg.Env)
 	
+	hub.OnPresence = announcePresence
+	hub.PublishInterceptors = []pkg.PublishInterceptor[pkg.JobStatus]{redactSecrets}
+	hub.InstrumentLock = os.Getenv("LOCK_STATS") == "true"
+	hub.LockLongHold = 2 * time.Second
 	hub.Init()
+	if _, err := hub.CreateFirehose(allJobs, "job:", 1000); err != nil {
+		log.Fatalf("Error creating %s: %s\n", allJobs, err)
+	}
 	go hub.Listen()
+	go publishPresence()
+	go hub.RunReaper(5 * time.Second, make(chan pkg.Empty))
 	
 	renderer = render.New(&render.Config{
 		ViewPaths:     []string{ "web_app_views" },
@@ -227,7 +442,9 @@ func main() {
 	http.Handle("/", http.HandlerFunc(root))
 	http.Handle("/jobs", http.HandlerFunc(createJob))
 	http.Handle("/jobs/", http.HandlerFunc(job))
+	http.Handle("/jobs/all/stream", http.HandlerFunc(streamAllJobs))
 	http.Handle("/subscriptions", http.HandlerFunc(subscriptions))
+	http.Handle("/metrics", http.HandlerFunc(metrics))
 
 	var addr string = "localhost:8081"
 	port := os.Getenv("PORT")
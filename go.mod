@@ -2,14 +2,17 @@ module github.com/mikedll/smoothcriminal
 
 go 1.18
 
-require pkg v1.0.0
+require (
+	github.com/gorilla/websocket v1.5.0
+	github.com/qor/render v1.1.1
+	pkg v1.0.0
+)
 
 require (
 	github.com/aymerick/douceur v0.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/gorilla/css v1.0.0 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/gosimple/slug v1.9.0 // indirect
 	github.com/jinzhu/gorm v1.9.15 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
@@ -19,7 +22,6 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/qor/assetfs v0.0.0-20170713023933-ff57fdc13a14 // indirect
 	github.com/qor/qor v1.3.0 // indirect
-	github.com/qor/render v1.1.1 // indirect
 	github.com/rainycape/unidecode v0.0.0-20150907023854-cb7f23ec59be // indirect
 	github.com/stretchr/testify v1.8.3 // indirect
 	golang.org/x/net v0.2.0 // indirect
@@ -28,7 +28,7 @@ const subscriptions = () => {
   const subscriptions: Subscription[] = JSON.parse(window.subscriptions);
   subscriptions.forEach((s: Subscription) => {
     const li = document.createElement('li');
-    li.appendChild(document.createTextNode(s.name));
+    li.appendChild(document.createTextNode(`${s.name} (owner: ${s.owner}, ${s.subscriberCount} subscriber(s), ${s.messageCount} message(s))`));
     ul.appendChild(li);
   });
 
@@ -50,6 +50,7 @@ const webSocket = () => {
     
   const messages = container.querySelector('.messages')!;
   const progressBar: HTMLDivElement = container.querySelector('.progress-bar')!;
+  const watchers = container.querySelector('.watchers')!;
 
   const addMessage = (m: string) => {
     const div = document.createElement("div");
@@ -64,14 +65,16 @@ const webSocket = () => {
     return;
   }
 
-  const ws = new WebSocket(`ws://${window.host}/jobs/${matches[1]}/stream`);
+  // Query params like ?types=message pass through as stream filters
+  const ws = new WebSocket(`ws://${window.host}/jobs/${matches[1]}/stream${location.search}`);
 
   ws.addEventListener("open", (event) => {
     addMessage("Web socket connection opened");
   });
 
   ws.addEventListener("message", (event) => {
-    const jobStatus: MessageJobStatus | PercentJobStatus = JSON.parse(event.data);
+    const envelope: Envelope<MessageJobStatus | PercentJobStatus | PresenceJobStatus> = JSON.parse(event.data);
+    const jobStatus = envelope.payload;
     switch(jobStatus.type) {
       case "message":
         addMessage(jobStatus.message);
@@ -80,11 +83,18 @@ const webSocket = () => {
         const wholeNum = Math.round(jobStatus.percentComplete * 100);
         progressBar.style.width = `${wholeNum}%`;
         break;
+      case "presence":
+        watchers.textContent = `${jobStatus.watchers ?? 0} watching`;
+        break;
     }
   });
 
   ws.addEventListener("close", (event) => {
-    addMessage("Web socket connection closed.");
+    if(event.reason !== '') {
+      addMessage(`Web socket connection closed: ${event.reason} (code ${event.code}).`);
+    } else {
+      addMessage("Web socket connection closed.");
+    }
   });
 };
 
@@ -1,6 +1,12 @@
 
 interface Subscription {
   name: string;
+  createdAt: string;
+  owner: string;
+  labels: { [key: string]: string };
+  subscriberCount: number;
+  messageCount: number;
+  lastPublishAt: string;
 }
 
 interface MessageJobStatus {
@@ -11,4 +17,19 @@ interface MessageJobStatus {
 interface PercentJobStatus {
   type: "complete"
   percentComplete: number;
-}
\ No newline at end of file
+}
+interface PresenceJobStatus {
+  type: "presence"
+  // Left out when nobody is watching
+  watchers?: number;
+}
+
+interface Envelope<T> {
+  id: string;
+  subscription: string;
+  seq: number;
+  publishedAt: string;
+  publisherId: string;
+  headers: { [key: string]: string } | null;
+  payload: T;
+}
@@ -0,0 +1,232 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//
+// Reader/writer lock shared between processes through a file in Dir,
+// with the same method names as ReadWriteLock. Methods return errors
+// since the file can fail to open.
+//
+// Writers leave their pid in the file and remove the file on unlock.
+// The OS drops the lock itself when a process dies, but the file and pid
+// stay behind, so the next writer can tell the previous one crashed.
+//
+// Only works where flock is available. Elsewhere every method returns
+// ErrFileLocksUnsupported.
+//
+type FileLock struct {
+	// Defaults to "tmp"
+	Dir string
+	Name string
+
+	// Set after each write lock to the pid of a previous writer that
+	// exited without unlocking, or 0.
+	StalePid int
+
+	mu semaphore
+	readers []*os.File
+	writer *os.File
+}
+
+var ErrFileLocksUnsupported = errors.New("File locks are not supported on this system")
+
+// Replaced in filelock_unix.go. Kept as variables rather than split
+// across build-tagged files, which would clash when the package's files
+// are passed to go test by name.
+var flock = func(file *os.File, write bool, wait bool) (bool, error) {
+	return false, ErrFileLocksUnsupported
+}
+
+var funlock = func(file *os.File) error {
+	return ErrFileLocksUnsupported
+}
+
+var processAlive = func(pid int) bool {
+	return true
+}
+
+func (fl *FileLock) Init() {
+	if fl.Dir == "" {
+		fl.Dir = "tmp"
+	}
+	fl.mu = make(semaphore, 1)
+}
+
+func (fl *FileLock) Path() string {
+	return filepath.Join(fl.Dir, fl.Name)
+}
+
+func (fl *FileLock) open() (*os.File, error) {
+	if err := os.MkdirAll(fl.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(fl.Path(), os.O_RDWR|os.O_CREATE, 0644)
+}
+
+func (fl *FileLock) LockForReading() error {
+	_, err := fl.lock(false, true)
+	return err
+}
+
+func (fl *FileLock) TryLockForReading() (bool, error) {
+	return fl.lock(false, false)
+}
+
+func (fl *FileLock) LockForWriting() error {
+	_, err := fl.lock(true, true)
+	return err
+}
+
+//
+// Returns false without waiting if any process holds the lock.
+//
+func (fl *FileLock) TryLockForWriting() (bool, error) {
+	return fl.lock(true, false)
+}
+
+func (fl *FileLock) lock(write bool, wait bool) (bool, error) {
+	var file *os.File
+	for {
+		var err error
+		file, err = fl.open()
+		if err != nil {
+			return false, err
+		}
+
+		ok, err := flock(file, write, wait)
+		if err != nil || !ok {
+			file.Close()
+			return false, err
+		}
+
+		// A writer may have removed the file while this one waited on it,
+		// in which case the lock is on a file nobody else will open
+		if fl.stillAtPath(file) {
+			break
+		}
+		funlock(file)
+		file.Close()
+	}
+
+	fl.mu.P()
+	defer fl.mu.V()
+
+	if !write {
+		fl.readers = append(fl.readers, file)
+		return true, nil
+	}
+
+	fl.writer = file
+	fl.StalePid = 0
+	if pid, _ := readPid(file); pid != 0 && pid != os.Getpid() && !processAlive(pid) {
+		fl.StalePid = pid
+	}
+
+	if err := writePid(file, os.Getpid()); err != nil {
+		fl.writer = nil
+		funlock(file)
+		file.Close()
+		return false, err
+	}
+	return true, nil
+}
+
+func (fl *FileLock) ReadingUnlock() error {
+	fl.mu.P()
+	if len(fl.readers) == 0 {
+		fl.mu.V()
+		return errors.New(fmt.Sprintf("File lock %s is not held for reading", fl.Path()))
+	}
+	file := fl.readers[len(fl.readers)-1]
+	fl.readers = fl.readers[:len(fl.readers)-1]
+	fl.mu.V()
+
+	funlock(file)
+	return file.Close()
+}
+
+func (fl *FileLock) WritingUnlock() error {
+	fl.mu.P()
+	file := fl.writer
+	fl.writer = nil
+	fl.mu.V()
+
+	if file == nil {
+		return errors.New(fmt.Sprintf("File lock %s is not held for writing", fl.Path()))
+	}
+
+	// Removed while still locked, so nobody can take the lock on it and
+	// think they hold it
+	err := os.Remove(fl.Path())
+	funlock(file)
+	file.Close()
+	return err
+}
+
+func (fl *FileLock) stillAtPath(file *os.File) bool {
+	opened, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	current, err := os.Stat(fl.Path())
+	if err != nil {
+		return false
+	}
+	return os.SameFile(opened, current)
+}
+
+//
+// Pid left by the last writer, and whether that process is still
+// running. Returns 0 if no writer has the lock or left a pid behind.
+//
+func (fl *FileLock) Holder() (int, bool, error) {
+	file, err := os.Open(fl.Path())
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	pid, err := readPid(file)
+	if err != nil || pid == 0 {
+		return 0, false, err
+	}
+	return pid, processAlive(pid), nil
+}
+
+func readPid(file *os.File) (int, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	bytes, err := io.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+
+	content := strings.TrimSpace(string(bytes))
+	if content == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(content)
+}
+
+func writePid(file *os.File, pid int) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err := file.WriteAt([]byte(strconv.Itoa(pid) + "\n"), 0)
+	return err
+}
@@ -0,0 +1,156 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package pkg
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// Run as a separate process by the tests below. Takes the lock, says so,
+// and exits without unlocking once stdin closes, like a crash.
+//
+func TestFileLockHelper(t *testing.T) {
+	dir := os.Getenv("FILELOCK_HELPER_DIR")
+	if dir == "" {
+		return
+	}
+
+	fl := &FileLock{Dir: dir, Name: "job-1.lock"}
+	fl.Init()
+	if err := fl.LockForWriting(); err != nil {
+		os.Exit(2)
+	}
+	os.Stdout.WriteString("locked\n")
+
+	bufio.NewReader(os.Stdin).ReadString('\n')
+	os.Exit(1)
+}
+
+func TestFileLock(t *testing.T) {
+	dir := t.TempDir()
+	fl := &FileLock{Dir: dir, Name: "job-1.lock"}
+	fl.Init()
+	other := &FileLock{Dir: dir, Name: "job-1.lock"}
+	other.Init()
+
+	assert.Nil(t, fl.LockForReading())
+	ok, err := other.TryLockForReading()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = other.TryLockForWriting()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, fl.ReadingUnlock())
+	assert.Nil(t, other.ReadingUnlock())
+	assert.NotNil(t, other.ReadingUnlock())
+
+	assert.Nil(t, fl.LockForWriting())
+	assert.Equal(t, 0, fl.StalePid)
+	pid, alive, err := other.Holder()
+	assert.Nil(t, err)
+	assert.Equal(t, os.Getpid(), pid)
+	assert.True(t, alive)
+
+	ok, err = other.TryLockForReading()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, fl.WritingUnlock())
+	assert.NotNil(t, fl.WritingUnlock())
+	pid, _, err = other.Holder()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pid)
+
+	// Writers clean up after themselves
+	_, err = os.Stat(fl.Path())
+	assert.True(t, os.IsNotExist(err))
+}
+
+//
+// A writer that was waiting on the file when it was removed has to
+// lock the new one, or two writers could hold the lock at once.
+//
+func TestFileLockRemovedWhileWaiting(t *testing.T) {
+	dir := t.TempDir()
+	fl := &FileLock{Dir: dir, Name: "job-1.lock"}
+	fl.Init()
+	waiter := &FileLock{Dir: dir, Name: "job-1.lock"}
+	waiter.Init()
+	late := &FileLock{Dir: dir, Name: "job-1.lock"}
+	late.Init()
+
+	assert.Nil(t, fl.LockForWriting())
+
+	locked := make(chan Empty, 1)
+	g1 := make(chan Empty)
+	go func() {
+		assert.Nil(t, waiter.LockForWriting())
+		locked <- Em
+		g1 <- Em
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 0, len(locked))
+
+	assert.Nil(t, fl.WritingUnlock())
+	<-g1
+
+	ok, err := late.TryLockForWriting()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, waiter.WritingUnlock())
+	ok, err = late.TryLockForWriting()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, late.WritingUnlock())
+}
+
+func TestFileLockCrashedHolder(t *testing.T) {
+	dir := t.TempDir()
+	fl := &FileLock{Dir: dir, Name: "job-1.lock"}
+	fl.Init()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFileLockHelper$")
+	cmd.Env = append(os.Environ(), "FILELOCK_HELPER_DIR=" + dir)
+	stdin, err := cmd.StdinPipe()
+	assert.Nil(t, err)
+	stdout, err := cmd.StdoutPipe()
+	assert.Nil(t, err)
+	assert.Nil(t, cmd.Start())
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "locked\n", line)
+
+	// Held by the other process
+	ok, err := fl.TryLockForWriting()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	pid, alive, err := fl.Holder()
+	assert.Nil(t, err)
+	assert.Equal(t, cmd.Process.Pid, pid)
+	assert.True(t, alive)
+
+	stdin.Close()
+	cmd.Wait()
+
+	// The OS let go of the lock, but the pid is left behind
+	pid, alive, err = fl.Holder()
+	assert.Nil(t, err)
+	assert.Equal(t, cmd.Process.Pid, pid)
+	assert.False(t, alive)
+
+	ok, err = fl.TryLockForWriting()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, cmd.Process.Pid, fl.StalePid)
+	assert.Nil(t, fl.WritingUnlock())
+}
@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"fmt"
+	"errors"
+	"strings"
+	"strconv"
+	"net/url"
+)
+
+//
+// Builds a JobStatus filter from query params, like the ones on
+// /jobs/1/stream?types=message or ?minComplete=0.5. Types can be
+// comma separated or repeated. minComplete only applies to "complete"
+// events. Returns nil if there's nothing to filter on.
+//
+func ParseJobStatusFilter(query url.Values) (func(JobStatus) bool, error) {
+	types := map[string]bool{}
+	for _, param := range query["types"] {
+		for _, t := range strings.Split(param, ",") {
+			t = strings.TrimSpace(t)
+			if t != "" {
+				types[t] = true
+			}
+		}
+	}
+
+	hasMin := false
+	minComplete := 0.0
+	if param := query.Get("minComplete"); param != "" {
+		parsed, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid minComplete: %s", param))
+		}
+		hasMin = true
+		minComplete = parsed
+	}
+
+	if len(types) == 0 && !hasMin {
+		return nil, nil
+	}
+
+	return func(status JobStatus) bool {
+		if len(types) > 0 && !types[status.Type] {
+			return false
+		}
+
+		if hasMin && status.Type == "complete" && status.Complete < minComplete {
+			return false
+		}
+
+		return true
+	}, nil
+}
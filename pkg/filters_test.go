@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"net/url"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJobStatusFilterEmpty(t *testing.T) {
+	filter, err := ParseJobStatusFilter(url.Values{})
+	assert.Nil(t, err)
+	assert.Nil(t, filter)
+}
+
+func TestParseJobStatusFilterTypes(t *testing.T) {
+	query, _ := url.ParseQuery("types=message")
+	filter, err := ParseJobStatusFilter(query)
+	assert.Nil(t, err)
+
+	assert.True(t, filter(JobStatus{Type: "message", Message: "Part 1"}))
+	assert.False(t, filter(JobStatus{Type: "complete", Complete: 0.5}))
+	assert.False(t, filter(JobStatus{Type: "presence", Watchers: 2}))
+
+	query, _ = url.ParseQuery("types=message,presence")
+	filter, err = ParseJobStatusFilter(query)
+	assert.Nil(t, err)
+	assert.True(t, filter(JobStatus{Type: "presence", Watchers: 2}))
+
+	query, _ = url.ParseQuery("types=message&types=complete")
+	filter, err = ParseJobStatusFilter(query)
+	assert.Nil(t, err)
+	assert.True(t, filter(JobStatus{Type: "complete", Complete: 0.5}))
+	assert.False(t, filter(JobStatus{Type: "presence", Watchers: 2}))
+}
+
+func TestParseJobStatusFilterMinComplete(t *testing.T) {
+	query, _ := url.ParseQuery("minComplete=0.5")
+	filter, err := ParseJobStatusFilter(query)
+	assert.Nil(t, err)
+
+	assert.False(t, filter(JobStatus{Type: "complete", Complete: 0.4}))
+	assert.True(t, filter(JobStatus{Type: "complete", Complete: 0.5}))
+	assert.True(t, filter(JobStatus{Type: "message", Message: "Part 1"}))
+
+	query, _ = url.ParseQuery("minComplete=half")
+	_, err = ParseJobStatusFilter(query)
+	assert.Equal(t, errors.New("Invalid minComplete: half"), err)
+}
@@ -4,6 +4,10 @@ package pkg
 import (
 	"fmt"
 	"errors"
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
 	"github.com/google/uuid"
 )
 
@@ -12,42 +16,413 @@ const (
 	HubCmdMessage          = 1
 	HubCmdShutdown         = 2
 	HubCmdRemoveSubscriber = 3
+	HubCmdReap             = 4
+	HubCmdMessageBatch     = 6
 )
 
+const (
+	sendDelivered int = 0
+	sendDead          = 1
+	sendTimedOut      = 2
+	sendFiltered      = 3
+	sendDropped       = 4
+)
+
+//
+// Why a subscriber's MsgCh was closed.
+//
+type CloseReason string
+
+const (
+	CloseFinished  CloseReason = "finished"
+	CloseFailed    CloseReason = "failed"
+	CloseCancelled CloseReason = "cancelled"
+	CloseReaped    CloseReason = "reaped"
+	CloseShutdown  CloseReason = "shutdown"
+
+	// Subscriber left on its own, so there's rarely anyone to tell.
+	CloseUnsubscribed CloseReason = "unsubscribed"
+)
+
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+)
+
+//
+// Returned by TryPublish and PublishTimeout when CommandCh is full.
+//
+var ErrHubBusy = errors.New("Hub is busy")
+
 type JobStatus struct {
 	Type string        `json:"type"`
 	Complete float64   `json:"percentComplete"`
 	Message string     `json:"message"`
+	Watchers int       `json:"watchers,omitempty"`
 }
 
-type Sendable interface {
-	string | JobStatus
-}
+//
+// Hubs carry any type. A Hub[any] can be shared by several Topic
+// handles of different types.
+//
+type Sendable = any
 
 type HubChannel[T Sendable] struct {
 	Id string
+	Meta map[string]string
+	Group string
+	Filter func(T) bool
 	ClientPings chan Empty
 	MsgCh chan T
+
+	// Retained messages waiting to go out ahead of anything newer.
+	// Only touched by Listen() once subscribed.
+	backlog []Envelope[T]
+
+	// Newest Seq among the retained messages when it subscribed.
+	// Publishes up to here are already in the backlog, or came before
+	// it joined, so Listen() skips them.
+	retainedSeq int
+
+	// Set just before each message goes out on MsgCh.
+	lastEnvelope Envelope[T]
+
+	// Set just before MsgCh is closed.
+	reason CloseReason
+
+	// Set on subscribers of a conflated subscription or a firehose.
+	// Messages wait in pending, where ones with the same key collapse,
+	// and a pump goroutine hands them to the client. See offer() for
+	// what happens once maxPending is reached.
+	conflateKey func(T) string
+	maxPending int
+	pending []*pendingEnvelope[T]
+	pendingLock semaphore
+	wake chan Empty
+	room chan Empty
+	done chan Empty
+	finishing bool
+}
+
+//
+// A message waiting for the pump, with its conflation key worked out
+// once when it's queued.
+//
+type pendingEnvelope[T Sendable] struct {
+	env Envelope[T]
+	key string
+
+	// Set by PublishSync, which is told how the message fared: one of
+	// sendDelivered, sendDead or sendDropped. Has room for the answer,
+	// so the pump never waits on it.
+	outcome chan int
+
+	// Guarded by pendingLock. The pump sets taken just before handing the
+	// message over. PublishSync sets withdrawn if it gives up first.
+	taken bool
+	withdrawn bool
+}
+
+func (queued *pendingEnvelope[T]) tell(status int) {
+	if queued.outcome != nil {
+		queued.outcome <- status
+	}
+}
+
+//
+// A published message along with where and when it came from. Seq
+// counts up from 1 for each subscription.
+//
+type Envelope[T Sendable] struct {
+	Id string                   `json:"id"`
+	Subscription string         `json:"subscription"`
+	Seq int                     `json:"seq"`
+	PublishedAt time.Time       `json:"publishedAt"`
+	PublisherId string          `json:"publisherId"`
+	Headers map[string]string   `json:"headers"`
+	Message T                   `json:"payload"`
+}
+
+//
+// Optional settings for PublishWithOpts.
+//
+type PublishOpts struct {
+	PublisherId string
+	Headers map[string]string
+
+	// Don't count the publish as activity, so it doesn't hold off
+	// reaping by IdleTTL. For bookkeeping like presence counts.
+	Quiet bool
 }
 
 type HubSubscription struct {
-	Name string     `json:"name"`
+	Name string                 `json:"name"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Owner string                `json:"owner"`
+	Labels map[string]string    `json:"labels"`
+	SubscriberCount int         `json:"subscriberCount"`
+	MessageCount int            `json:"messageCount"`
+	LastPublishAt time.Time     `json:"lastPublishAt"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+	Dropped int                 `json:"dropped"`
+	idleTTL time.Duration
+
+	// Source of MessageCount, LastPublishAt and Dropped in snapshots.
+	counters *publishCounters
+}
+
+//
+// Publish counts for a subscription. Listen() updates them atomically,
+// so it doesn't need the lock to do so.
+//
+type publishCounters struct {
+	messageCount int64
+	dropped int64
+
+	// Holds a time.Time once anything is published
+	lastPublishAt atomic.Value
+}
+
+func (c *publishCounters) lastPublish() time.Time {
+	if at, ok := c.lastPublishAt.Load().(time.Time); ok {
+		return at
+	}
+	return time.Time{}
+}
+
+//
+// Pending messages a subscriber of a conflated subscription can have
+// when SubscriptionOpts.MaxPending isn't set.
+//
+const DefaultMaxPending = 1000
+
+//
+// Optional settings for CreateSubscriptionWithOpts.
+//
+type SubscriptionOpts[T Sendable] struct {
+	Owner string
+	Labels map[string]string
+
+	// Subscription is reaped after going this long without a publish.
+	// Zero means never.
+	IdleTTL time.Duration
+
+	// Lets subscribers fall behind without holding up the hub. Their
+	// undelivered messages collapse to the newest one per key. Messages
+	// for which Conflate returns "" never collapse.
+	Conflate func(T) string
+
+	// With Conflate set, the most messages a subscriber can have waiting.
+	// Past that the oldest message with a key is dropped and counted in
+	// Dropped. Messages without a key are never dropped. If nothing else
+	// is waiting, publishing waits for the subscriber instead. Defaults
+	// to DefaultMaxPending.
+	MaxPending int
+}
+
+//
+// Sent to Hub.OnPresence when a subscriber joins or leaves a subscription.
+// Count is the number of subscribers left after the change.
+//
+type PresenceEvent struct {
+	Type string                 `json:"type"`
+	Subscription string         `json:"subscription"`
+	SubscriberId string         `json:"subscriberId"`
+	Meta map[string]string      `json:"meta"`
+	Count int                   `json:"count"`
+}
+
+//
+// Optional settings for SubscribeWithOpts.
+//
+type SubscriberOpts[T Sendable] struct {
+	// Passed along in presence events.
+	Meta map[string]string
+
+	// Subscribers sharing a group take turns receiving messages, so
+	// each message goes to only one of them.
+	Group string
+
+	// Messages for which this returns false are skipped.
+	Filter func(T) bool
 }
 
+//
+// Sees every published message before it is queued. Can return a changed
+// message, or an error to reject it.
+//
+type PublishInterceptor[T Sendable] func(name string, message T) (T, error)
+
+//
+// Sees every Subscribe before it happens. Can change the options, or
+// return an error to deny the subscription.
+//
+type SubscribeInterceptor[T Sendable] func(name string, opts *SubscriberOpts[T]) error
+
 type HubCommand[T Sendable] struct {
 	CmdType int
 	Subscription string
 	Message T
 	SubscriberId string
+
+	// If set, the message replaces the subscription's retained
+	// value for this key.
+	RetainKey string
+
+	// Used instead of Message by HubCmdMessageBatch.
+	Messages []T
+
+	// Copied into the envelope of each message.
+	PublishedAt time.Time
+	PublisherId string
+	Headers map[string]string
+
+	// Leaves LastPublishAt alone. See PublishOpts.
+	Quiet bool
+
+	// Given to subscribers by HubCmdRemoveSub.
+	Reason CloseReason
+
+	// Set by PublishSync. Ctx bounds the wait on each subscriber.
+	// Listen() closes Started when it gets to the message, and sends
+	// the outcome on Report.
+	Ctx context.Context
+	Started chan Empty
+	Report chan DeliveryReport
+}
+
+//
+// Outcome of PublishSync. Filtered counts subscribers whose filter
+// skipped the message. Dropped counts messages that subscribers of a
+// conflated subscription lost to make room for this one.
+//
+type DeliveryReport struct {
+	Reached int     `json:"reached"`
+	Dead int        `json:"dead"`
+	TimedOut int    `json:"timedOut"`
+	Filtered int    `json:"filtered"`
+	Dropped int     `json:"dropped"`
+}
+
+func (r *DeliveryReport) add(status int) {
+	switch status {
+	case sendDelivered:
+		r.Reached += 1
+	case sendDead:
+		r.Dead += 1
+	case sendTimedOut:
+		r.TimedOut += 1
+	case sendFiltered:
+		r.Filtered += 1
+	case sendDropped:
+		r.Dropped += 1
+	}
+}
+
+//
+// What publishing reads. It's replaced, never changed, whenever
+// subscriptions, subscribers or firehoses come and go, so it can be read
+// without the lock.
+//
+type hubSnapshot[T Sendable] struct {
+	subscribers map[string][]*HubChannel[T]
+	counters map[string]*publishCounters
+	firehoses []firehose
+}
+
+type firehose struct {
+	name string
+	prefix string
+	maxPending int
+	counters *publishCounters
+}
+
+type conflation[T Sendable] struct {
+	key func(T) string
+	maxPending int
+}
+
+type backlogFlush struct {
+	subscription string
+	subscriberId string
+}
+
+//
+// Last value published under each retain key, in the order
+// the keys were first seen.
+//
+type retainedValues[T Sendable] struct {
+	keys []string
+	values map[string]Envelope[T]
 }
 
 type Hub[T Sendable] struct {
 	Ids map[string]bool
 	Subscribers map[string][]*HubChannel[T]
 	Subscriptions map[string]*HubSubscription
+
+	// Holds a *hubSnapshot[T], copied from Subscriptions, Subscribers
+	// and firehoses with the write lock held.
+	snapshot atomic.Value
+
+	// Have publishing look up subscriptions, subscribers and firehoses
+	// under the read lock instead of in the snapshot. Mostly for
+	// comparing the two.
+	LockedPublishReads bool
+
 	CommandChSize int
 	CommandCh chan HubCommand[T]
-	Lock *ReadWriteLock
+
+	// Set before Init to use another lock, such as a sync.RWMutex from
+	// NewRWMutexLocker. Defaults to a ReadWriteLock set up from the
+	// LockPolicy, InstrumentLock and LockLongHold fields.
+	Lock RWLocker
+
+	// Next member of each queue group to receive a message, by
+	// subscription and group. Only touched by Listen().
+	groupCursors map[string]map[string]int
+
+	// Retained messages by subscription.
+	retained map[string]*retainedValues[T]
+
+	// Conflated subscriptions by name.
+	conflations map[string]conflation[T]
+
+	// New subscribers whose backlog Listen() hasn't sent yet. Subscribe
+	// adds to it and pokes flushWake, which Listen() selects on next to
+	// CommandCh so a busy hub never holds up Subscribe.
+	unflushed []backlogFlush
+	flushWake chan Empty
+
+	// Firehose subscriptions by name.
+	firehoses map[string]firehose
+
+	// Fairness policy for Lock. Read-heavy hubs, such as ones with
+	// LockedPublishReads set, may want LockPolicyReaderPreferring.
+	LockPolicy LockPolicy
+
+	// Record contention stats on the default lock. Read them by
+	// type-asserting Lock to *ReadWriteLock and calling Stats().
+	InstrumentLock bool
+
+	// With Debug on, report anyone holding Lock longer than this.
+	LockLongHold time.Duration
+
+	// Subscriptions are reaped once they are this old. Zero means never.
+	MaxLifetime time.Duration
+
+	// Clock used for metadata and reaping. Defaults to time.Now.
+	Now func() time.Time
+
+	// Called after Subscribe and removeSubscriber, without the lock held.
+	// Leave events are usually sent from the Listen() goroutine, so this
+	// must not block on CommandCh.
+	OnPresence func(PresenceEvent)
+
+	// Run in order on every publish and subscribe. Set these up
+	// before the hub is in use.
+	PublishInterceptors []PublishInterceptor[T]
+	SubscribeInterceptors []SubscribeInterceptor[T]
 }
 
 func (hCh *HubChannel[T]) Init() {
@@ -55,6 +430,272 @@ func (hCh *HubChannel[T]) Init() {
 	hCh.MsgCh = make(chan T)
 }
 
+func (hCh *HubChannel[T]) initPump(key func(T) string, maxPending int) {
+	hCh.conflateKey = key
+	hCh.maxPending = maxPending
+	hCh.pendingLock = make(semaphore, 1)
+	hCh.wake = make(chan Empty, 1)
+	hCh.room = make(chan Empty, 1)
+	hCh.done = make(chan Empty)
+}
+
+func (hCh *HubChannel[T]) pumped() bool {
+	return hCh.wake != nil
+}
+
+func (hCh *HubChannel[T]) pendingFor(env Envelope[T]) *pendingEnvelope[T] {
+	queued := &pendingEnvelope[T]{env: env}
+	if hCh.conflateKey != nil {
+		queued.key = hCh.conflateKey(env.Message)
+	}
+	return queued
+}
+
+//
+// Queues a message for the pump. An undelivered message with the same
+// key is dropped in favor of this one. An empty key never conflates.
+//
+// Once maxPending messages are waiting, the oldest one with a key is
+// dropped to make room. Firehoses have no keys, so they drop the oldest
+// message. If every waiting message must be kept, this waits for the
+// pump to make room, returning sendTimedOut if ctx is done first, or
+// sendDead if the subscriber goes away. Also returns how many messages
+// were dropped to make room. Messages that are replaced or dropped are
+// told so.
+//
+func (hCh *HubChannel[T]) offer(ctx context.Context, queued *pendingEnvelope[T]) (int, int) {
+	dropped := 0
+	for {
+		hCh.pendingLock.P()
+		if hCh.finishing {
+			hCh.pendingLock.V()
+			return sendDead, dropped
+		}
+
+		if queued.key != "" {
+			for i, pending := range hCh.pending {
+				if pending.key == queued.key {
+					hCh.pending = append(hCh.pending[:i], hCh.pending[i+1:]...)
+					pending.tell(sendDropped)
+					break
+				}
+			}
+		}
+		if hCh.full() {
+			i := hCh.evictable()
+			if i == -1 {
+				hCh.pendingLock.V()
+				select {
+				case <-hCh.room:
+				case <-hCh.done:
+				case <-ctx.Done():
+					return sendTimedOut, dropped
+				}
+				continue
+			}
+
+			hCh.pending[i].tell(sendDropped)
+			hCh.pending = append(hCh.pending[:i], hCh.pending[i+1:]...)
+			dropped += 1
+		}
+		hCh.pending = append(hCh.pending, queued)
+		hCh.pendingLock.V()
+		break
+	}
+
+	select {
+	case hCh.wake <- Em:
+	default:
+	}
+	return sendDelivered, dropped
+}
+
+//
+// True if offer() would queue the message without waiting.
+//
+func (hCh *HubChannel[T]) canQueue(env Envelope[T]) bool {
+	queued := hCh.pendingFor(env)
+	hCh.pendingLock.P()
+	defer hCh.pendingLock.V()
+
+	if hCh.finishing || !hCh.full() || hCh.evictable() != -1 {
+		return true
+	}
+	for _, pending := range hCh.pending {
+		if queued.key != "" && pending.key == queued.key {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Marks the message as handed to the client. Returns false if
+// PublishSync already gave up on it.
+//
+func (hCh *HubChannel[T]) take(queued *pendingEnvelope[T]) bool {
+	hCh.pendingLock.P()
+	defer hCh.pendingLock.V()
+
+	if queued.withdrawn {
+		return false
+	}
+	queued.taken = true
+	return true
+}
+
+//
+// Keeps the message from reaching the client. Returns false if the pump
+// has already taken it.
+//
+func (hCh *HubChannel[T]) withdraw(queued *pendingEnvelope[T]) bool {
+	hCh.pendingLock.P()
+	defer hCh.pendingLock.V()
+
+	if queued.taken {
+		return false
+	}
+	queued.withdrawn = true
+	for i, pending := range hCh.pending {
+		if pending == queued {
+			hCh.pending = append(hCh.pending[:i], hCh.pending[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+//
+// Tells everything still pending that it won't be delivered. For when
+// the pump stops early.
+//
+func (hCh *HubChannel[T]) abandonPending() {
+	hCh.pendingLock.P()
+	for _, pending := range hCh.pending {
+		pending.tell(sendDead)
+	}
+	hCh.pending = nil
+	hCh.pendingLock.V()
+}
+
+//
+// Called with pendingLock held.
+//
+func (hCh *HubChannel[T]) full() bool {
+	return hCh.maxPending > 0 && len(hCh.pending) >= hCh.maxPending
+}
+
+//
+// Index of the oldest pending message that may be dropped to make room,
+// or -1 if there's none. Called with pendingLock held.
+//
+func (hCh *HubChannel[T]) evictable() int {
+	for i, pending := range hCh.pending {
+		if hCh.conflateKey == nil || pending.key != "" {
+			return i
+		}
+	}
+	return -1
+}
+
+//
+// Tells the pump to deliver what's pending and then stop, closing
+// MsgCh for the given reason.
+//
+func (hCh *HubChannel[T]) finish(reason CloseReason) {
+	hCh.pendingLock.P()
+	if !hCh.finishing {
+		hCh.finishing = true
+		hCh.reason = reason
+		close(hCh.done)
+	}
+	hCh.pendingLock.V()
+}
+
+//
+// Waits for the next pending message. Returns false once finish() has
+// been called and nothing is left.
+//
+func (hCh *HubChannel[T]) nextPending() (*pendingEnvelope[T], bool) {
+	for {
+		hCh.pendingLock.P()
+		if len(hCh.pending) > 0 {
+			queued := hCh.pending[0]
+			hCh.pending = hCh.pending[1:]
+			hCh.pendingLock.V()
+
+			select {
+			case hCh.room <- Em:
+			default:
+			}
+			return queued, true
+		}
+		finishing := hCh.finishing
+		hCh.pendingLock.V()
+
+		if finishing {
+			return nil, false
+		}
+
+		select {
+		case <-hCh.wake:
+		case <-hCh.done:
+		}
+	}
+}
+
+//
+// Envelope of the message last received from MsgCh. Read it after
+// receiving, and before pinging for the next one.
+//
+func (hCh *HubChannel[T]) LastEnvelope() Envelope[T] {
+	return hCh.lastEnvelope
+}
+
+//
+// Why MsgCh was closed. Read it once MsgCh reports closed.
+//
+func (hCh *HubChannel[T]) Reason() CloseReason {
+	return hCh.reason
+}
+
+//
+// Closes MsgCh, recording why.
+//
+func (hCh *HubChannel[T]) closeWithReason(reason CloseReason) {
+	hCh.reason = reason
+	close(hCh.MsgCh)
+}
+
+func (hCh *HubChannel[T]) accepts(message T) bool {
+	return hCh.Filter == nil || hCh.Filter(message)
+}
+
+//
+// Like IsClientAlive(), but gives up with ctx's error.
+//
+func (hCh *HubChannel[T]) waitForClient(ctx context.Context) (bool, error) {
+	select {
+	case _, ok := <-hCh.ClientPings:
+		return ok, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+//
+// Like IsClientAlive(), but doesn't wait. pinged is false if the client
+// hasn't pinged or closed yet.
+//
+func (hCh *HubChannel[T]) pollClient() (alive bool, pinged bool) {
+	select {
+	case _, ok := <-hCh.ClientPings:
+		return ok, true
+	default:
+		return false, false
+	}
+}
+
 //
 // Hub Listen() should check this to see if client has sent
 // a ping and is ready for a message.
@@ -65,120 +706,717 @@ func (hCh *HubChannel[T]) IsClientAlive() bool {
 }
 
 //
-// Clients should close the connection, indicating they're done reading.
+// Clients should close the connection, indicating they're done reading.
+//
+func (hCh *HubChannel[T]) Close() {
+	close(hCh.ClientPings)
+}
+
+//
+// Clients should send this to indicate they want a message,
+// or done indicator.
+//
+func (hCh *HubChannel[T]) ClientPing() {
+	hCh.ClientPings <- Empty{}
+}
+
+func (h *Hub[T]) Init() {
+	h.Ids = make(map[string]bool)
+	h.Subscribers = make(map[string][]*HubChannel[T])
+	h.snapshot.Store(&hubSnapshot[T]{subscribers: map[string][]*HubChannel[T]{}, counters: map[string]*publishCounters{}})
+	h.Subscriptions = make(map[string]*HubSubscription)
+	h.groupCursors = make(map[string]map[string]int)
+	h.retained = make(map[string]*retainedValues[T])
+	h.conflations = make(map[string]conflation[T])
+	h.firehoses = make(map[string]firehose)
+	h.CommandCh = make(chan HubCommand[T], h.CommandChSize)
+	h.flushWake = make(chan Empty, 1)
+	if h.Lock == nil {
+		lock := &ReadWriteLock{Policy: h.LockPolicy, Instrumented: h.InstrumentLock, LongHold: h.LockLongHold}
+		lock.Init()
+		h.Lock = lock
+	}
+	if h.Now == nil {
+		h.Now = time.Now
+	}
+}
+
+//
+// Copy of the subscription that callers can read without holding
+// the hub lock. The hub keeps updating the original.
+//
+func (sub *HubSubscription) snapshot() *HubSubscription {
+	cpy := *sub
+	cpy.Labels = make(map[string]string, len(sub.Labels))
+	for k, v := range sub.Labels {
+		cpy.Labels[k] = v
+	}
+	cpy.MessageCount = int(atomic.LoadInt64(&sub.counters.messageCount))
+	cpy.Dropped = int(atomic.LoadInt64(&sub.counters.dropped))
+	cpy.LastPublishAt = sub.counters.lastPublish()
+	return &cpy
+}
+
+func (h *Hub[T]) CreateSubscription(name string) (*HubSubscription, error) {
+	return h.CreateSubscriptionWithOpts(name, SubscriptionOpts[T]{})
+}
+
+func (h *Hub[T]) CreateSubscriptionWithOpts(name string, opts SubscriptionOpts[T]) (*HubSubscription, error) {
+	h.Lock.LockForWriting()
+
+	if _, ok := h.Subscriptions[name]; ok {
+		h.Lock.WritingUnlock()
+		return nil, errors.New(fmt.Sprintf("Subscription already exists with name '%s'", name))
+	}
+
+	next := &HubSubscription{Name: name, CreatedAt: h.Now(), Owner: opts.Owner, Labels: map[string]string{}, idleTTL: opts.IdleTTL, counters: &publishCounters{}}
+	for k, v := range opts.Labels {
+		next.Labels[k] = v
+	}
+	if h.MaxLifetime > 0 {
+		next.ExpiresAt = next.CreatedAt.Add(h.MaxLifetime)
+	}
+	h.Subscriptions[name] = next
+	if opts.Conflate != nil {
+		maxPending := opts.MaxPending
+		if maxPending == 0 {
+			maxPending = DefaultMaxPending
+		}
+		h.conflations[name] = conflation[T]{key: opts.Conflate, maxPending: maxPending}
+	}
+	h.snapshotCounters(name)
+
+	ret := next.snapshot()
+	h.Lock.WritingUnlock()
+	return ret, nil
+}
+
+//
+// Creates a subscription that gets a copy of everything published to
+// subscriptions whose names start with prefix. Envelope.Subscription
+// and Envelope.Seq still name the source. Each firehose subscriber
+// is fed by its own goroutine, so a slow one never holds up the source
+// subscriptions. Instead, once maxPending messages are waiting for it, the
+// oldest is dropped and counted in the firehose's Dropped. Zero means
+// no limit. Firehoses never expire.
+//
+func (h *Hub[T]) CreateFirehose(name string, prefix string, maxPending int) (*HubSubscription, error) {
+	h.Lock.LockForWriting()
+
+	if _, ok := h.Subscriptions[name]; ok {
+		h.Lock.WritingUnlock()
+		return nil, errors.New(fmt.Sprintf("Subscription already exists with name '%s'", name))
+	}
+
+	next := &HubSubscription{Name: name, CreatedAt: h.Now(), Labels: map[string]string{"firehose": prefix}, counters: &publishCounters{}}
+	h.Subscriptions[name] = next
+	h.firehoses[name] = firehose{name: name, prefix: prefix, maxPending: maxPending, counters: next.counters}
+	h.snapshotCounters(name)
+	h.snapshotFirehoses()
+
+	ret := next.snapshot()
+	h.Lock.WritingUnlock()
+	return ret, nil
+}
+
+//
+// Firehoses that should get a copy of what was just published to
+// source, with their counts bumped. Publishing to a firehose directly
+// doesn't fan out further.
+//
+func (h *Hub[T]) firehosesFor(source string, count int) []string {
+	var firehoses []firehose
+	if !h.LockedPublishReads {
+		firehoses = h.loadSnapshot().firehoses
+	} else {
+		h.Lock.LockForReading()
+		for _, fh := range h.firehoses {
+			firehoses = append(firehoses, fh)
+		}
+		h.Lock.ReadingUnlock()
+	}
+
+	for _, fh := range firehoses {
+		if fh.name == source {
+			return nil
+		}
+	}
+
+	ret := []string{}
+	for _, fh := range firehoses {
+		if strings.HasPrefix(source, fh.prefix) {
+			atomic.AddInt64(&fh.counters.messageCount, int64(count))
+			fh.counters.lastPublishAt.Store(h.Now())
+			ret = append(ret, fh.name)
+		}
+	}
+	return ret
+}
+
+//
+// Swaps in a new snapshot with the firehoses copied from firehoses.
+// Called with the write lock held.
+//
+func (h *Hub[T]) snapshotFirehoses() {
+	next := *h.loadSnapshot()
+	next.firehoses = make([]firehose, 0, len(h.firehoses))
+	for _, fh := range h.firehoses {
+		next.firehoses = append(next.firehoses, fh)
+	}
+	h.snapshot.Store(&next)
+}
+
+func (h *Hub[T]) GetSubscription(name string) *HubSubscription {
+	h.Lock.LockForReading()
+	sub, ok := h.Subscriptions[name]
+	if !ok {
+		h.Lock.ReadingUnlock()
+		return nil
+	}
+	ret := sub.snapshot()
+	h.Lock.ReadingUnlock()
+	return ret
+}
+
+func (h *Hub[T]) GetSubscriptions() []*HubSubscription {
+	h.Lock.LockForReading()
+	ret := []*HubSubscription{}
+	for _, sub := range h.Subscriptions {
+		ret = append(ret, sub.snapshot())
+	}
+	h.Lock.ReadingUnlock()
+	return ret
+}
+
+func (h *Hub[T]) Subscribe(name string) (*HubChannel[T], error) {
+	return h.SubscribeWithOpts(name, SubscriberOpts[T]{})
+}
+
+func (h *Hub[T]) SubscribeWithOpts(name string, opts SubscriberOpts[T]) (*HubChannel[T], error) {
+	for _, interceptor := range h.SubscribeInterceptors {
+		if err := interceptor(name, &opts); err != nil {
+			return nil, err
+		}
+	}
+
+	h.Lock.LockForWriting()
+	
+	if _, ok := h.Subscriptions[name]; !ok {
+		h.Lock.WritingUnlock()
+		return nil, errors.New(fmt.Sprintf("Subscription does not exist: %s", name))
+	}
+
+	if _, ok := h.Subscribers[name]; !ok {
+		h.Subscribers[name] = []*HubChannel[T]{}
+	}
+
+	nextUUID := uuid.New()
+	if _, ok := h.Ids[nextUUID.String()]; ok {
+		h.Lock.WritingUnlock()
+		return nil, errors.New("UUID collision")
+	}
+
+	h.Ids[nextUUID.String()] = true
+	next := &HubChannel[T]{Id: nextUUID.String(), Meta: opts.Meta, Group: opts.Group, Filter: opts.Filter}
+	next.Init()
+	if conflation, ok := h.conflations[name]; ok {
+		next.initPump(conflation.key, conflation.maxPending)
+	} else if firehose, ok := h.firehoses[name]; ok {
+		next.initPump(nil, firehose.maxPending)
+	}
+	if retained, ok := h.retained[name]; ok {
+		for _, key := range retained.keys {
+			if seq := retained.values[key].Seq; seq > next.retainedSeq {
+				next.retainedSeq = seq
+			}
+			if !next.accepts(retained.values[key].Message) {
+				continue
+			}
+
+			if next.pumped() {
+				// The pump hasn't started, so there's no waiting for room
+				next.pending = append(next.pending, next.pendingFor(retained.values[key]))
+			} else {
+				next.backlog = append(next.backlog, retained.values[key])
+			}
+		}
+	}
+	h.Subscribers[name] = append(h.Subscribers[name], next)
+	h.snapshotSubscribers(name)
+	h.Subscriptions[name].SubscriberCount = len(h.Subscribers[name])
+	event := PresenceEvent{Type: PresenceJoin, Subscription: name, SubscriberId: next.Id, Meta: opts.Meta, Count: len(h.Subscribers[name])}
+	if len(next.backlog) > 0 {
+		h.unflushed = append(h.unflushed, backlogFlush{subscription: name, subscriberId: next.Id})
+		select {
+		case h.flushWake <- Em:
+		default:
+		}
+	}
+	h.Lock.WritingUnlock()
+	h.emitPresence(event)
+
+	if next.pumped() {
+		go h.pump(name, next)
+	}
+	return next, nil
+}
+
+//
+// The returned slice is shared, so don't change it.
+//
+func (h *Hub[T]) SubscribersFor(name string) []*HubChannel[T] {
+	if !h.LockedPublishReads {
+		if subscribers, ok := h.loadSnapshot().subscribers[name]; ok {
+			return subscribers
+		}
+		return []*HubChannel[T]{}
+	}
+
+	h.Lock.LockForReading()
+	if _, ok := h.Subscribers[name]; !ok {
+		h.Lock.ReadingUnlock()
+		return []*HubChannel[T]{}
+	}
+
+	cpy := append([]*HubChannel[T]{}, h.Subscribers[name]...)
+	h.Lock.ReadingUnlock()
+	return cpy
+}
+
+func (h *Hub[T]) loadSnapshot() *hubSnapshot[T] {
+	return h.snapshot.Load().(*hubSnapshot[T])
+}
+
+//
+// Swaps in a new snapshot with name's subscribers copied from Subscribers.
+// Called with the write lock held.
+//
+func (h *Hub[T]) snapshotSubscribers(name string) {
+	next := *h.loadSnapshot()
+	old := next.subscribers
+	next.subscribers = make(map[string][]*HubChannel[T], len(old) + 1)
+	for k, v := range old {
+		if k != name {
+			next.subscribers[k] = v
+		}
+	}
+
+	if subscribers, ok := h.Subscribers[name]; ok {
+		cpy := make([]*HubChannel[T], len(subscribers))
+		copy(cpy, subscribers)
+		next.subscribers[name] = cpy
+	}
+	h.snapshot.Store(&next)
+}
+
+//
+// Swaps in a new snapshot with name's counters copied from Subscriptions.
+// Called with the write lock held.
+//
+func (h *Hub[T]) snapshotCounters(name string) {
+	next := *h.loadSnapshot()
+	old := next.counters
+	next.counters = make(map[string]*publishCounters, len(old) + 1)
+	for k, v := range old {
+		if k != name {
+			next.counters[k] = v
+		}
+	}
+
+	if sub, ok := h.Subscriptions[name]; ok {
+		next.counters[name] = sub.counters
+	}
+	h.snapshot.Store(&next)
+}
+
+//
+// Counters of the named subscription, or nil if there's no such
+// subscription.
+//
+func (h *Hub[T]) countersFor(name string) *publishCounters {
+	if !h.LockedPublishReads {
+		return h.loadSnapshot().counters[name]
+	}
+
+	h.Lock.LockForReading()
+	var ret *publishCounters
+	if sub, ok := h.Subscriptions[name]; ok {
+		ret = sub.counters
+	}
+	h.Lock.ReadingUnlock()
+	return ret
+}
+
+func (h *Hub[T]) checkSubscription(name string) error {
+	if h.countersFor(name) == nil {
+		return errors.New(fmt.Sprintf("Subscription does not exist: %s", name))
+	}
+	return nil
+}
+
+//
+// Runs the message through PublishInterceptors in order. The first
+// error stops the chain.
+//
+func (h *Hub[T]) interceptPublish(name string, message T) (T, error) {
+	for _, interceptor := range h.PublishInterceptors {
+		var err error
+		message, err = interceptor(name, message)
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+	return message, nil
+}
+
+//
+// Like interceptPublish, but each interceptor sees the whole batch before
+// the next one runs. An interceptor that rejects any message keeps later
+// ones, such as an audit log, from seeing the batch at all. Earlier ones
+// have already seen it.
+//
+func (h *Hub[T]) interceptBatch(name string, messages []T) ([]T, error) {
+	// Copied so the caller can reuse its slice, and so interceptors
+	// don't change it
+	batch := make([]T, len(messages))
+	copy(batch, messages)
+
+	for _, interceptor := range h.PublishInterceptors {
+		for i, message := range batch {
+			intercepted, err := interceptor(name, message)
+			if err != nil {
+				return nil, err
+			}
+			batch[i] = intercepted
+		}
+	}
+	return batch, nil
+}
+
+func (h *Hub[T]) messageCmd(name string, message T) HubCommand[T] {
+	return HubCommand[T]{CmdType: HubCmdMessage, Subscription: name, Message: message, PublishedAt: h.Now()}
+}
+
+//
+// Common start to every publish: the subscription must exist and
+// interceptors must accept the message.
+//
+func (h *Hub[T]) preparePublish(name string, message T) (T, error) {
+	if err := h.checkSubscription(name); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return h.interceptPublish(name, message)
+}
+
+//
+// Returns an error if the subscription doesn't exist. The check reads
+// the snapshot, so publishing takes no lock.
+//
+func (h *Hub[T]) PublishTo(name string, message T) error {
+	message, err := h.preparePublish(name, message)
+	if err != nil {
+		return err
+	}
+
+	// fmt.Printf("PublishTo(): Sending into activity %p\n", h.CommandCh)
+	h.CommandCh <- h.messageCmd(name, message)
+	return nil
+}
+
+//
+// Like PublishTo, but fills in the publisher and headers on the
+// message's envelope.
+//
+func (h *Hub[T]) PublishWithOpts(name string, message T, opts PublishOpts) error {
+	message, err := h.preparePublish(name, message)
+	if err != nil {
+		return err
+	}
+
+	cmd := h.messageCmd(name, message)
+	cmd.PublisherId = opts.PublisherId
+	cmd.Quiet = opts.Quiet
+	cmd.Headers = map[string]string{}
+	for k, v := range opts.Headers {
+		cmd.Headers[k] = v
+	}
+	h.CommandCh <- cmd
+	return nil
+}
+
+//
+// Like PublishTo, but returns ErrHubBusy instead of waiting for
+// room in CommandCh.
+//
+func (h *Hub[T]) TryPublish(name string, message T) error {
+	message, err := h.preparePublish(name, message)
+	if err != nil {
+		return err
+	}
+
+	return h.tryQueue(h.messageCmd(name, message))
+}
+
+//
+// Like PublishRetained, but returns ErrHubBusy instead of waiting for
+// room in CommandCh. Nothing is retained if the message is dropped.
+//
+func (h *Hub[T]) TryPublishRetained(name string, key string, message T) error {
+	message, err := h.preparePublish(name, message)
+	if err != nil {
+		return err
+	}
+
+	cmd := h.messageCmd(name, message)
+	cmd.RetainKey = key
+	return h.tryQueue(cmd)
+}
+
+func (h *Hub[T]) tryQueue(cmd HubCommand[T]) error {
+	select {
+	case h.CommandCh <- cmd:
+		return nil
+	default:
+		return ErrHubBusy
+	}
+}
+
+//
+// Like PublishTo, but returns ErrHubBusy if there's no room in
+// CommandCh within the timeout.
+//
+func (h *Hub[T]) PublishTimeout(name string, message T, timeout time.Duration) error {
+	message, err := h.preparePublish(name, message)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case h.CommandCh <- h.messageCmd(name, message):
+		return nil
+	case <-timer.C:
+		return ErrHubBusy
+	}
+}
+
+//
+// Publishes a message and waits until Listen() has treated it. Subscribers
+// that haven't pinged by the time ctx is done are skipped, and counted
+// as timed out. For a conflated subscription, that means waiting until
+// the pump hands each subscriber the message. One that is still waiting
+// when ctx is done never gets it. If ctx is done before Listen() gets to the message, for
+// example because it's still busy with earlier ones, ctx.Err() is returned
+// and the message may still be published later.
+//
+func (h *Hub[T]) PublishSync(ctx context.Context, name string, message T) (DeliveryReport, error) {
+	message, err := h.preparePublish(name, message)
+	if err != nil {
+		return DeliveryReport{}, err
+	}
+
+	started := make(chan Empty)
+	report := make(chan DeliveryReport, 1)
+	cmd := h.messageCmd(name, message)
+	cmd.Ctx = ctx
+	cmd.Started = started
+	cmd.Report = report
+	select {
+	case h.CommandCh <- cmd:
+	case <-ctx.Done():
+		return DeliveryReport{}, ctx.Err()
+	}
+
+	// Report has room, so Listen() isn't held up if nobody is waiting
+	select {
+	case r := <-report:
+		return r, nil
+	case <-ctx.Done():
+	}
+
+	// Once Listen() has started on the message, its waits are all bounded
+	// by ctx, so the report is on its way
+	select {
+	case <-started:
+		return <-report, nil
+	default:
+		return DeliveryReport{}, ctx.Err()
+	}
+}
+
+//
+// Publishes several messages with one subscription check and one
+// command. Each subscriber gets them in order. If an interceptor rejects
+// any of them, none are published.
+//
+func (h *Hub[T]) PublishBatch(name string, messages []T) error {
+	if err := h.checkSubscription(name); err != nil {
+		return err
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	batch, err := h.interceptBatch(name, messages)
+	if err != nil {
+		return err
+	}
+
+	h.CommandCh <- HubCommand[T]{CmdType: HubCmdMessageBatch, Subscription: name, Messages: batch, PublishedAt: h.Now()}
+	return nil
+}
+
+//
+// Publishes a message and keeps it as the subscription's last value for
+// key. New subscribers get every retained value before anything else.
 //
-func (hCh *HubChannel[T]) Close() {
-	close(hCh.ClientPings)
+func (h *Hub[T]) PublishRetained(name string, key string, message T) error {
+	message, err := h.preparePublish(name, message)
+	if err != nil {
+		return err
+	}
+
+	cmd := h.messageCmd(name, message)
+	cmd.RetainKey = key
+	h.CommandCh <- cmd
+	return nil
 }
 
 //
-// Clients should send this to indicate they want a message,
-// or done indicator.
+// Bumps the message count and publish time of a subscription, and
+// stores the message if it is retained. Called by Listen() as it
+// treats each message. Returns the messages in their envelopes.
 //
-func (hCh *HubChannel[T]) ClientPing() {
-	hCh.ClientPings <- Empty{}
-}
+func (h *Hub[T]) recordPublish(cmd HubCommand[T]) []Envelope[T] {
+	messages := cmd.Messages
+	if cmd.CmdType != HubCmdMessageBatch {
+		messages = []T{cmd.Message}
+	}
 
-func (h *Hub[T]) Init() {
-	h.Ids = make(map[string]bool)
-	h.Subscribers = make(map[string][]*HubChannel[T])
-	h.Subscriptions = make(map[string]*HubSubscription)
-	h.CommandCh = make(chan HubCommand[T], h.CommandChSize)
-	h.Lock = &ReadWriteLock{}
-	h.Lock.Init()
-}
+	counters := h.countersFor(cmd.Subscription)
+	envelopes := []Envelope[T]{}
+	for _, message := range messages {
+		env := Envelope[T]{
+			Id: uuid.New().String(),
+			Subscription: cmd.Subscription,
+			PublishedAt: cmd.PublishedAt,
+			PublisherId: cmd.PublisherId,
+			Headers: cmd.Headers,
+			Message: message,
+		}
+		if counters != nil {
+			env.Seq = int(atomic.AddInt64(&counters.messageCount, 1))
+		}
+		envelopes = append(envelopes, env)
+	}
 
-func (h *Hub[T]) CreateSubscription(name string) (*HubSubscription, error) {
-	h.Lock.LockForWriting()
+	if counters == nil {
+		return envelopes
+	}
 
-	if _, ok := h.Subscriptions[name]; ok {
-		h.Lock.WritingUnlock()
-		return nil, errors.New(fmt.Sprintf("Subscription already exists with name '%s'", name))
+	if !cmd.Quiet {
+		counters.lastPublishAt.Store(h.Now())
 	}
 
-	next := &HubSubscription{Name: name}
-	h.Subscriptions[name] = next
+	// Subscribe reads retained values, so only retained messages
+	// need the lock
+	if cmd.RetainKey != "" {
+		h.Lock.LockForWriting()
+		retained, ok := h.retained[cmd.Subscription]
+		if !ok {
+			retained = &retainedValues[T]{values: map[string]Envelope[T]{}}
+			h.retained[cmd.Subscription] = retained
+		}
+		if _, ok := retained.values[cmd.RetainKey]; !ok {
+			retained.keys = append(retained.keys, cmd.RetainKey)
+		}
+		retained.values[cmd.RetainKey] = envelopes[0]
+		h.Lock.WritingUnlock()
+	}
 
-	h.Lock.WritingUnlock()
-	return next, nil
+	return envelopes
 }
 
-func (h *Hub[T]) GetSubscription(name string) *HubSubscription {
-	h.Lock.LockForReading()
-	sub := h.Subscriptions[name]
-	h.Lock.ReadingUnlock()
-	return sub
-}
+//
+// True if the subscription has gone idle past its TTL, or outlived
+// the hub's MaxLifetime.
+//
+func (sub *HubSubscription) isExpired(now time.Time) bool {
+	if !sub.ExpiresAt.IsZero() && !now.Before(sub.ExpiresAt) {
+		return true
+	}
 
-func (h *Hub[T]) GetSubscriptions() []*HubSubscription {
-	h.Lock.LockForReading()
-	ret := []*HubSubscription{}
-	for _, sub := range h.Subscriptions {
-		ret = append(ret, sub)
+	if sub.idleTTL > 0 {
+		lastActive := sub.CreatedAt
+		if lastPublish := sub.counters.lastPublish(); lastPublish.After(lastActive) {
+			lastActive = lastPublish
+		}
+		if now.Sub(lastActive) >= sub.idleTTL {
+			return true
+		}
 	}
-	h.Lock.ReadingUnlock()
-	return ret
+
+	return false
 }
 
-func (h *Hub[T]) Subscribe(name string) (*HubChannel[T], error) {
+//
+// Removes expired subscriptions. Runs from Listen() so it goes through
+// the same removal as HubCmdRemoveSub.
+//
+func (h *Hub[T]) reapExpired() {
 	h.Lock.LockForWriting()
-	
-	if _, ok := h.Subscriptions[name]; !ok {
-		h.Lock.WritingUnlock()
-		return nil, errors.New(fmt.Sprintf("Subscription does not exist: %s", name))
-	}
 
-	if _, ok := h.Subscribers[name]; !ok {
-		h.Subscribers[name] = []*HubChannel[T]{}
-	}
+	now := h.Now()
+	for name, sub := range h.Subscriptions {
+		if !sub.isExpired(now) {
+			continue
+		}
 
-	nextUUID := uuid.New()
-	if _, ok := h.Ids[nextUUID.String()]; ok {
-		h.Lock.WritingUnlock()
-		return nil, errors.New("UUID collision")
+		fmt.Printf("Reaping expired subscription: %s\n", name)
+		err := h.removeSubscription(name, true, CloseReaped)
+		if err != nil {
+			fmt.Printf("Error when reaping subscription %s: %s\n", name, err)
+		}
 	}
 
-	h.Ids[nextUUID.String()] = true
-	next := &HubChannel[T]{Id: nextUUID.String()}
-	next.Init()
-	h.Subscribers[name] = append(h.Subscribers[name], next)
-
 	h.Lock.WritingUnlock()
-	return next, nil
 }
 
-func (h *Hub[T]) SubscribersFor(name string) []*HubChannel[T] {
-	h.Lock.LockForReading()
-	if _, ok := h.Subscribers[name]; !ok {
-		h.Lock.ReadingUnlock()
-		return []*HubChannel[T]{}
+//
+// Asks Listen() to reap expired subscriptions. Does not block if the
+// CommandCh is full; the next call will catch anything missed.
+//
+func (h *Hub[T]) Reap() {
+	select {
+	case h.CommandCh <- HubCommand[T]{CmdType: HubCmdReap}:
+	default:
 	}
-
-	cpy := append([]*HubChannel[T]{}, h.Subscribers[name]...)
-	h.Lock.ReadingUnlock()
-	return cpy
 }
 
 //
-// This does not check for subscription existence, as that would
-// require a lock and slow things down. If the subscription does not
-// exist, the subcribers list will come back empty, and nothing will happen.
+// Calls Reap() every interval until stop is closed.
 //
-func (h *Hub[T]) PublishTo(name string, message T) error {
-	h.Lock.LockForReading()
-	
-	if _, ok := h.Subscriptions[name]; !ok {
-		h.Lock.ReadingUnlock()
-		return errors.New(fmt.Sprintf("Subscription does not exist: %s", name))
-	}
+func (h *Hub[T]) RunReaper(interval time.Duration, stop <-chan Empty) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	h.Lock.ReadingUnlock()
-	// fmt.Printf("PublishTo(): Sending into activity %p\n", h.CommandCh)
-	h.CommandCh <- HubCommand[T]{CmdType: HubCmdMessage, Subscription: name, Message: message}
-	return nil
+	for {
+		select {
+		case <-ticker.C:
+			h.Reap()
+		case <-stop:
+			return
+		}
+	}
 }
 
-func (h *Hub[T]) removeSubscription(name string, alreadyLocked bool) error {
+func (h *Hub[T]) removeSubscription(name string, alreadyLocked bool, reason CloseReason) error {
 	if !alreadyLocked {
 		h.Lock.LockForWriting()
 	}
@@ -192,16 +1430,31 @@ func (h *Hub[T]) removeSubscription(name string, alreadyLocked bool) error {
 	
 	if _, ok := h.Subscribers[name]; ok {
 		for _, subscriber := range h.Subscribers[name] {
+			if subscriber.pumped() {
+				// Pump closes MsgCh once it has delivered what's pending
+				subscriber.finish(reason)
+				continue
+			}
+
 			// fmt.Printf("Checking if client is alive from removeSubscription, Id=%s\n", subscriber.Id)
 			if subscriber.IsClientAlive() {
-				close(subscriber.MsgCh)
+				subscriber.closeWithReason(reason)
 			}
 		}
 		
 		delete(h.Subscribers, name)
+		h.snapshotSubscribers(name)
 	}
 
 	delete(h.Subscriptions, name)
+	h.snapshotCounters(name)
+	delete(h.groupCursors, name)
+	delete(h.retained, name)
+	delete(h.conflations, name)
+	if _, ok := h.firehoses[name]; ok {
+		delete(h.firehoses, name)
+		h.snapshotFirehoses()
+	}
 	if !alreadyLocked {
 		h.Lock.WritingUnlock()
 	}
@@ -212,7 +1465,7 @@ func (h *Hub[T]) removeAllSubscriptions() {
 	h.Lock.LockForWriting()
 
 	for name, _ := range h.Subscriptions {
-		err := h.removeSubscription(name, true)
+		err := h.removeSubscription(name, true, CloseShutdown)
 		if err != nil {
 			fmt.Printf("Error when removing subscription %s: %s", name, err)
 		}
@@ -222,6 +1475,14 @@ func (h *Hub[T]) removeAllSubscriptions() {
 }
 
 func (h *Hub[T]) RemoveSubscription(name string) error {
+	return h.RemoveSubscriptionWithReason(name, CloseFinished)
+}
+
+//
+// Like RemoveSubscription, but tells subscribers why, for example
+// CloseFailed when a job errors out.
+//
+func (h *Hub[T]) RemoveSubscriptionWithReason(name string, reason CloseReason) error {
 	h.Lock.LockForReading()
 	
 	if _, ok := h.Subscriptions[name]; !ok {
@@ -230,7 +1491,7 @@ func (h *Hub[T]) RemoveSubscription(name string) error {
 	}
 
 	h.Lock.ReadingUnlock()
-	h.CommandCh <- HubCommand[T]{CmdType: HubCmdRemoveSub, Subscription: name}
+	h.CommandCh <- HubCommand[T]{CmdType: HubCmdRemoveSub, Subscription: name, Reason: reason}
 
 	return nil
 }
@@ -239,14 +1500,24 @@ func (h *Hub[T]) Listen() {
 	Loop:
 	for {
 		// fmt.Printf("Listen(): reading an activity %p\n", h.CommandCh)
-		hubCommand := <-h.CommandCh
+		var hubCommand HubCommand[T]
+		select {
+		case hubCommand = <-h.CommandCh:
+		case <-h.flushWake:
+			h.flushBacklogs()
+			continue
+		}
 
 		switch hubCommand.CmdType {
 		case HubCmdShutdown:
 			fmt.Printf("Hub got Shutdown\n")
 			break Loop
 		case HubCmdRemoveSub:
-			err := h.removeSubscription(hubCommand.Subscription, false)
+			reason := hubCommand.Reason
+			if reason == "" {
+				reason = CloseFinished
+			}
+			err := h.removeSubscription(hubCommand.Subscription, false, reason)
 			if err != nil {
 				fmt.Printf("Error when removing subscription: %s\n", err)
 			}
@@ -256,20 +1527,26 @@ func (h *Hub[T]) Listen() {
 			if err != nil {
 				fmt.Printf("Error when removing subscriber: %s\n", err)
 			}
+		case HubCmdReap:
+			h.reapExpired()
 		case HubCmdMessage:
-			for _, subscriber := range h.SubscribersFor(hubCommand.Subscription) {
-				// fmt.Printf("Publishing to client %s\n", subscriber.Id)
-				if !subscriber.IsClientAlive() {					
-					// fmt.Printf("  Continuing because client is dead\n")
-					err := h.removeSubscriber(hubCommand.Subscription, subscriber.Id)
-					if err != nil {
-						fmt.Printf("Error when removing subscriber: %s\n", err)
-					}
-					continue
-				}
-				subscriber.MsgCh <- hubCommand.Message
-				// fmt.Printf("Done publishing to client %s\n", subscriber.Id)
+			if hubCommand.Started != nil {
+				close(hubCommand.Started)
+			}
+			envelopes := h.recordPublish(hubCommand)
+			ctx := hubCommand.Ctx
+			if ctx == nil {
+				ctx = context.Background()
 			}
+			report := h.deliver(ctx, hubCommand.Subscription, envelopes, hubCommand.Report != nil)
+			if hubCommand.Report != nil {
+				hubCommand.Report <- report
+			}
+			h.deliverToFirehoses(hubCommand.Subscription, envelopes)
+		case HubCmdMessageBatch:
+			envelopes := h.recordPublish(hubCommand)
+			h.deliver(context.Background(), hubCommand.Subscription, envelopes, false)
+			h.deliverToFirehoses(hubCommand.Subscription, envelopes)
 		}
 
 		// fmt.Printf("Looping in Listen()\n")
@@ -279,11 +1556,319 @@ func (h *Hub[T]) Listen() {
 	h.removeAllSubscriptions()
 }
 
-func (h *Hub[T]) removeSubscriber(name string, id string) error {
+//
+// Firehose subscribers are all pumped, so this doesn't block.
+//
+func (h *Hub[T]) deliverToFirehoses(source string, envelopes []Envelope[T]) {
+	if len(envelopes) == 0 {
+		return
+	}
+
+	for _, name := range h.firehosesFor(source, len(envelopes)) {
+		h.deliver(context.Background(), name, envelopes, false)
+	}
+}
+
+//
+// Sends messages in order to every subscriber outside a group. Each
+// message also goes to one member of each queue group. Waiting on any
+// one subscriber gives up when ctx is done. With confirm set, messages
+// queued for a pump are waited on until the client has them.
+//
+func (h *Hub[T]) deliver(ctx context.Context, name string, envelopes []Envelope[T], confirm bool) DeliveryReport {
+	report := DeliveryReport{}
+
+	// Only Listen() drops messages, so the difference is what this
+	// delivery dropped
+	counters := h.countersFor(name)
+	var dropped int64
+	if counters != nil {
+		dropped = atomic.LoadInt64(&counters.dropped)
+	}
+
+	groups := map[string][]*HubChannel[T]{}
+	groupOrder := []string{}
+
+	for _, subscriber := range h.SubscribersFor(name) {
+		if subscriber.Group != "" {
+			if _, ok := groups[subscriber.Group]; !ok {
+				groupOrder = append(groupOrder, subscriber.Group)
+			}
+			groups[subscriber.Group] = append(groups[subscriber.Group], subscriber)
+			continue
+		}
+
+		for _, env := range envelopes {
+			status := h.sendTo(ctx, name, subscriber, env, confirm)
+			report.add(status)
+			if status != sendDelivered && status != sendFiltered {
+				break
+			}
+		}
+	}
+
+	for _, group := range groupOrder {
+		for _, env := range envelopes {
+			h.sendToGroup(ctx, name, group, groups[group], env, confirm, &report)
+		}
+	}
+
+	if counters != nil {
+		report.Dropped += int(atomic.LoadInt64(&counters.dropped) - dropped)
+	}
+	return report
+}
+
+//
+// Gives the message to one member of the group. Members that have
+// already pinged are tried first, in round-robin order, so an idle member
+// isn't kept waiting on a busy one. If none has, each member is waited on
+// in turn, skipping dead ones and ones that time out on ctx, until one
+// takes it. Members that filter the message are skipped either way, and
+// the message only counts as filtered if every member filters it.
+//
+func (h *Hub[T]) sendToGroup(ctx context.Context, name string, group string, members []*HubChannel[T], env Envelope[T], confirm bool, report *DeliveryReport) {
+	if _, ok := h.groupCursors[name]; !ok {
+		h.groupCursors[name] = map[string]int{}
+	}
+
+	start := h.groupCursors[name][group]
+	accepted := false
+	notReady := []int{}
+	for i := 0; i < len(members); i++ {
+		idx := (start + i) % len(members)
+		if !members[idx].accepts(env.Message) {
+			continue
+		}
+		accepted = true
+
+		status, ok := h.trySendTo(ctx, name, members[idx], env, confirm)
+		if !ok {
+			notReady = append(notReady, idx)
+			continue
+		}
+		report.add(status)
+		if status == sendDelivered {
+			h.groupCursors[name][group] = idx + 1
+			return
+		}
+	}
+
+	if !accepted {
+		report.add(sendFiltered)
+		return
+	}
+
+	for _, idx := range notReady {
+		status := h.sendTo(ctx, name, members[idx], env, confirm)
+		report.add(status)
+		if status == sendDelivered {
+			h.groupCursors[name][group] = idx + 1
+			return
+		}
+	}
+}
+
+//
+// Like sendTo, but only if the subscriber can take the message without
+// waiting. Returns false if it can't. Subscribers with a backlog are
+// left to sendTo.
+//
+func (h *Hub[T]) trySendTo(ctx context.Context, name string, subscriber *HubChannel[T], env Envelope[T], confirm bool) (int, bool) {
+	if subscriber.pumped() {
+		if env.Seq <= subscriber.retainedSeq {
+			return sendDelivered, true
+		}
+		if !subscriber.canQueue(env) {
+			return 0, false
+		}
+		return h.sendOne(ctx, name, subscriber, env, confirm), true
+	}
+
+	if len(subscriber.backlog) > 0 {
+		return 0, false
+	}
+
+	alive, pinged := subscriber.pollClient()
+	if !pinged {
+		return 0, false
+	}
+	return h.handOff(name, subscriber, env, alive), true
+}
+
+//
+// Sends new subscribers their retained messages, unless a publish
+// already did.
+//
+func (h *Hub[T]) flushBacklogs() {
 	h.Lock.LockForWriting()
+	flushes := h.unflushed
+	h.unflushed = nil
+	h.Lock.WritingUnlock()
+
+	for _, flush := range flushes {
+		for _, subscriber := range h.SubscribersFor(flush.subscription) {
+			if subscriber.Id == flush.subscriberId {
+				h.sendBacklog(context.Background(), flush.subscription, subscriber)
+				break
+			}
+		}
+	}
+}
+
+//
+// Anything not sent stays in the backlog for next time.
+//
+func (h *Hub[T]) sendBacklog(ctx context.Context, name string, subscriber *HubChannel[T]) int {
+	for len(subscriber.backlog) > 0 {
+		status := h.sendOne(ctx, name, subscriber, subscriber.backlog[0], false)
+		if status != sendDelivered {
+			return status
+		}
+		subscriber.backlog = subscriber.backlog[1:]
+	}
+
+	subscriber.backlog = nil
+	return sendDelivered
+}
+
+//
+// Dead subscribers are removed. Ones that time out are left alone.
+//
+func (h *Hub[T]) sendTo(ctx context.Context, name string, subscriber *HubChannel[T], env Envelope[T], confirm bool) int {
+	if !subscriber.accepts(env.Message) {
+		return sendFiltered
+	}
+
+	status := h.sendBacklog(ctx, name, subscriber)
+	if status != sendDelivered || env.Seq <= subscriber.retainedSeq {
+		return status
+	}
+
+	return h.sendOne(ctx, name, subscriber, env, confirm)
+}
+
+//
+// Pumped subscribers count as sent to once the message is queued, unless
+// confirm is set.
+//
+func (h *Hub[T]) sendOne(ctx context.Context, name string, subscriber *HubChannel[T], env Envelope[T], confirm bool) int {
+	if subscriber.pumped() {
+		queued := subscriber.pendingFor(env)
+		if confirm {
+			queued.outcome = make(chan int, 1)
+		}
+		status, dropped := subscriber.offer(ctx, queued)
+		if dropped > 0 {
+			if counters := h.countersFor(name); counters != nil {
+				atomic.AddInt64(&counters.dropped, int64(dropped))
+			}
+		}
+		if status != sendDelivered || !confirm {
+			return status
+		}
+		return h.awaitPump(ctx, subscriber, queued)
+	}
+
+	// fmt.Printf("Publishing to client %s\n", subscriber.Id)
+	alive, err := subscriber.waitForClient(ctx)
+	if err != nil {
+		return sendTimedOut
+	}
+
+	return h.handOff(name, subscriber, env, alive)
+}
+
+//
+// Waits for the pump to say how the message fared. If ctx is done first,
+// the message is withdrawn so it can't arrive after being counted as
+// timed out.
+//
+func (h *Hub[T]) awaitPump(ctx context.Context, subscriber *HubChannel[T], queued *pendingEnvelope[T]) int {
+	select {
+	case status := <-queued.outcome:
+		return status
+	case <-ctx.Done():
+	}
+
+	if subscriber.withdraw(queued) {
+		return sendTimedOut
+	}
+
+	// The client has pinged for it, so it's on its way
+	return <-queued.outcome
+}
+
+//
+// Finishes a send once the client has pinged, or closed if it isn't alive.
+//
+func (h *Hub[T]) handOff(name string, subscriber *HubChannel[T], env Envelope[T], alive bool) int {
+	if !alive {
+		// fmt.Printf("  Continuing because client is dead\n")
+		err := h.removeSubscriber(name, subscriber.Id)
+		if err != nil {
+			fmt.Printf("Error when removing subscriber: %s\n", err)
+		}
+		return sendDead
+	}
+
+	subscriber.lastEnvelope = env
+	subscriber.MsgCh <- env.Message
+	// fmt.Printf("Done publishing to client %s\n", subscriber.Id)
+	return sendDelivered
+}
+
+//
+// Runs for each subscriber of a conflated subscription, doing the
+// client handshake that Listen() does for everyone else.
+//
+func (h *Hub[T]) pump(name string, subscriber *HubChannel[T]) {
+	// A ping is kept for the next message if PublishSync withdrew the one
+	// it was meant for
+	pinged := false
+	for {
+		queued, ok := subscriber.nextPending()
+		if !ok {
+			break
+		}
+
+		if !pinged && !subscriber.IsClientAlive() {
+			subscriber.pendingLock.P()
+			alreadyRemoved := subscriber.finishing
+			subscriber.pendingLock.V()
+
+			if !alreadyRemoved {
+				err := h.removeSubscriber(name, subscriber.Id)
+				if err != nil {
+					fmt.Printf("Error when removing subscriber: %s\n", err)
+				}
+			}
+			queued.tell(sendDead)
+			subscriber.abandonPending()
+			return
+		}
+		pinged = true
+
+		if !subscriber.take(queued) {
+			continue
+		}
+		subscriber.lastEnvelope = queued.env
+		subscriber.MsgCh <- queued.env.Message
+		queued.tell(sendDelivered)
+		pinged = false
+	}
+
+	// Subscription or subscriber was removed. Reason was set by finish().
+	if pinged || subscriber.IsClientAlive() {
+		close(subscriber.MsgCh)
+	}
+}
+
+func (h *Hub[T]) removeSubscriber(name string, id string) error {
+	h.lockForUpgradableReading()
 	
 	if _, ok := h.Subscriptions[name]; !ok {
-		h.Lock.WritingUnlock()
+		h.upgradableReadingUnlock()
 		return errors.New(fmt.Sprintf("Subscription does not exist: %s", name))
 	}
 
@@ -297,13 +1882,54 @@ func (h *Hub[T]) removeSubscriber(name string, id string) error {
 	if idx == -1 {
 		// This can happen if a subscriber is removed during publishing and
 		// before its HubCmdRemoveSubscriber is treated.
-		h.Lock.WritingUnlock()
+		h.upgradableReadingUnlock()
 		return nil
 	}
 
+	h.upgradeToWriting()
+	removed := h.Subscribers[name][idx]
+	if removed.pumped() {
+		removed.finish(CloseUnsubscribed)
+	}
 	delete(h.Ids, id)
 	h.Subscribers[name] = append(h.Subscribers[name][:idx], h.Subscribers[name][idx+1:]...)
+	h.snapshotSubscribers(name)
+	h.Subscriptions[name].SubscriberCount = len(h.Subscribers[name])
+	event := PresenceEvent{Type: PresenceLeave, Subscription: name, SubscriberId: id, Meta: removed.Meta, Count: len(h.Subscribers[name])}
 	h.Lock.WritingUnlock()
+
+	h.emitPresence(event)
 	return nil
 }
 
+//
+// Locks that can't upgrade are locked for writing from the start.
+//
+func (h *Hub[T]) lockForUpgradableReading() {
+	if lock, ok := h.Lock.(UpgradableRWLocker); ok {
+		lock.LockForUpgradableReading()
+	} else {
+		h.Lock.LockForWriting()
+	}
+}
+
+func (h *Hub[T]) upgradableReadingUnlock() {
+	if lock, ok := h.Lock.(UpgradableRWLocker); ok {
+		lock.UpgradableReadingUnlock()
+	} else {
+		h.Lock.WritingUnlock()
+	}
+}
+
+func (h *Hub[T]) upgradeToWriting() {
+	if lock, ok := h.Lock.(UpgradableRWLocker); ok {
+		lock.UpgradeToWriting()
+	}
+}
+
+func (h *Hub[T]) emitPresence(event PresenceEvent) {
+	if h.OnPresence != nil {
+		h.OnPresence(event)
+	}
+}
+
@@ -2,8 +2,11 @@
 package pkg
 
 import (
-	_ "fmt"
+	"fmt"
 	"errors"
+	"context"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 	"github.com/stretchr/testify/assert"
@@ -97,6 +100,1635 @@ func TestGetSubscriptions(t *testing.T) {
 	assert.ElementsMatch(t, []string{"job:1", "job:2", "job:3"}, names)
 }
 
+func TestSubscriptionMetadata(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	before := time.Now()
+	_, err := hub.CreateSubscriptionWithOpts("job:1", SubscriptionOpts[string]{Owner: "mike", Labels: map[string]string{"kind": "exec"}})
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	cli1, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+	cli2, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	sub := hub.GetSubscription("job:1")
+	assert.Equal(t, "mike", sub.Owner)
+	assert.Equal(t, map[string]string{"kind": "exec"}, sub.Labels)
+	assert.False(t, sub.CreatedAt.Before(before))
+	assert.Equal(t, 2, sub.SubscriberCount)
+	assert.Equal(t, 0, sub.MessageCount)
+	assert.True(t, sub.LastPublishAt.IsZero())
+
+	// Labels on the returned copy don't leak back into the hub
+	sub.Labels["kind"] = "changed"
+	assert.Equal(t, "exec", hub.GetSubscription("job:1").Labels["kind"])
+
+	// First subscriber is dead, and is removed before the second gets the message
+	cli1.Close()
+	hub.PublishTo("job:1", "Hello Mike")
+	cli2.ClientPing()
+	m, ok := <-cli2.MsgCh
+	assert.True(t, ok)
+	assert.Equal(t, "Hello Mike", m)
+
+	sub = hub.GetSubscription("job:1")
+	assert.Equal(t, 1, sub.SubscriberCount)
+	assert.Equal(t, 1, sub.MessageCount)
+	assert.False(t, sub.LastPublishAt.Before(sub.CreatedAt))
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	cli2.ClientPing()
+	<-g1
+}
+
+func TestReapIdleSubscription(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	hub := &Hub[string]{Now: func() time.Time { return now }}
+	hub.Init()
+
+	idle, _ := time.ParseDuration("30s")
+	_, err := hub.CreateSubscriptionWithOpts("job:1", SubscriptionOpts[string]{IdleTTL: idle})
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	cli, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	// Not yet idle long enough
+	now = now.Add(29 * time.Second)
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdReap}
+	hub.PublishTo("job:1", "Hello Mike")
+	cli.ClientPing()
+	m, ok := <-cli.MsgCh
+	assert.True(t, ok)
+	assert.Equal(t, "Hello Mike", m)
+
+	// Publish above reset the idle timer
+	now = now.Add(29 * time.Second)
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdReap}
+	assert.NotNil(t, hub.GetSubscription("job:1"))
+
+	now = now.Add(1 * time.Second)
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdReap}
+	cli.ClientPing()
+	_, ok = <-cli.MsgCh
+	assert.False(t, ok)
+	assert.Nil(t, hub.GetSubscription("job:1"))
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestReapIdleQuietPublish(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	hub := &Hub[string]{Now: func() time.Time { return now }}
+	hub.Init()
+
+	idle, _ := time.ParseDuration("30s")
+	_, err := hub.CreateSubscriptionWithOpts("job:1", SubscriptionOpts[string]{IdleTTL: idle})
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	cli, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	now = now.Add(29 * time.Second)
+	hub.PublishWithOpts("job:1", "1 watching", PublishOpts{Quiet: true})
+	cli.ClientPing()
+	m, ok := <-cli.MsgCh
+	assert.True(t, ok)
+	assert.Equal(t, "1 watching", m)
+	assert.Equal(t, 1, hub.GetSubscription("job:1").MessageCount)
+	assert.True(t, hub.GetSubscription("job:1").LastPublishAt.IsZero())
+
+	// Quiet publish didn't reset the idle timer
+	now = now.Add(1 * time.Second)
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdReap}
+	cli.ClientPing()
+	_, ok = <-cli.MsgCh
+	assert.False(t, ok)
+	assert.Equal(t, CloseReaped, cli.Reason())
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestReapMaxLifetime(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	hub := &Hub[string]{Now: func() time.Time { return now }, MaxLifetime: time.Hour}
+	hub.Init()
+
+	sub, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(time.Hour), sub.ExpiresAt)
+
+	_, err = hub.CreateSubscription("job:2")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	cli, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	now = now.Add(59 * time.Minute)
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdReap}
+	hub.PublishTo("job:1", "Hello Mike")
+	cli.ClientPing()
+	_, ok := <-cli.MsgCh
+	assert.True(t, ok)
+
+	// Publishing doesn't extend the maximum lifetime
+	now = now.Add(1 * time.Minute)
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdReap}
+	cli.ClientPing()
+	_, ok = <-cli.MsgCh
+	assert.False(t, ok)
+	assert.Nil(t, hub.GetSubscription("job:2"))
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestReapDoesNotBlock(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	// Nobody is listening, and CommandCh has no buffer
+	hub.Reap()
+}
+
+func TestPresence(t *testing.T) {
+	events := make(chan PresenceEvent, 10)
+	hub := &Hub[string]{OnPresence: func(e PresenceEvent) { events <- e }}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	cli1, err := hub.SubscribeWithOpts("job:1", SubscriberOpts[string]{Meta: map[string]string{"user": "mike"}})
+	assert.Nil(t, err)
+	cli2, err := hub.SubscribeWithOpts("job:1", SubscriberOpts[string]{Meta: map[string]string{"user": "carol"}})
+	assert.Nil(t, err)
+
+	assert.Equal(t, PresenceEvent{Type: PresenceJoin, Subscription: "job:1", SubscriberId: cli1.Id, Meta: map[string]string{"user": "mike"}, Count: 1}, <-events)
+	assert.Equal(t, PresenceEvent{Type: PresenceJoin, Subscription: "job:1", SubscriberId: cli2.Id, Meta: map[string]string{"user": "carol"}, Count: 2}, <-events)
+
+	// Leave is noticed when publishing to a closed client
+	cli1.Close()
+	hub.PublishTo("job:1", "Hello Carol")
+	cli2.ClientPing()
+	<-cli2.MsgCh
+
+	assert.Equal(t, PresenceEvent{Type: PresenceLeave, Subscription: "job:1", SubscriberId: cli1.Id, Meta: map[string]string{"user": "mike"}, Count: 1}, <-events)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	cli2.ClientPing()
+	<-g1
+
+	assert.Empty(t, events)
+}
+
+func groupWorker(t *testing.T, hub *Hub[string], group string, joined chan<- Empty, received chan<- []string) {
+	cli, err := hub.SubscribeWithOpts("job:1", SubscriberOpts[string]{Group: group})
+	assert.Nil(t, err)
+	assert.Equal(t, group, cli.Group)
+
+	joined <- Em
+
+	messages := []string{}
+	for {
+		cli.ClientPing()
+		if m, ok := <-cli.MsgCh; ok {
+			messages = append(messages, m)
+		} else {
+			break
+		}
+	}
+
+	received <- messages
+}
+
+func TestQueueGroup(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	// Join one at a time so group order is known
+	joined := make(chan Empty)
+	workers := [](chan []string){}
+	for i := 0; i < 3; i++ {
+		received := make(chan []string, 1)
+		workers = append(workers, received)
+		go groupWorker(t, hub, "workers", joined, received)
+		<-joined
+	}
+
+	// Ungrouped subscriber gets everything
+	watcher := make(chan []string, 1)
+	go groupWorker(t, hub, "", joined, watcher)
+	<-joined
+
+	published := []string{"a", "b", "c", "d", "e", "f", "g"}
+	for _, m := range published {
+		hub.PublishTo("job:1", m)
+	}
+	hub.RemoveSubscription("job:1")
+
+	// Members that are ready go first, so the split depends on timing,
+	// but each message goes to exactly one of them
+	got := []string{}
+	for _, worker := range workers {
+		got = append(got, <-worker...)
+	}
+	assert.ElementsMatch(t, published, got)
+	assert.Equal(t, published, <-watcher)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestQueueGroupPrefersReadyMember(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	// First in line, but never asks for a message
+	idle, err := hub.SubscribeWithOpts("job:1", SubscriberOpts[string]{Group: "workers"})
+	assert.Nil(t, err)
+
+	joined := make(chan Empty)
+	received := make(chan []string, 1)
+	go groupWorker(t, hub, "workers", joined, received)
+	<-joined
+
+	for _, m := range []string{"a", "b"} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		report, err := hub.PublishSync(ctx, "job:1", m)
+		cancel()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, report.Reached)
+	}
+
+	idle.Close()
+	hub.RemoveSubscription("job:1")
+	assert.Equal(t, []string{"a", "b"}, <-received)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestQueueGroupSkipsDeadMember(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	dead, err := hub.SubscribeWithOpts("job:1", SubscriberOpts[string]{Group: "workers"})
+	assert.Nil(t, err)
+	dead.Close()
+
+	joined := make(chan Empty)
+	received := make(chan []string, 1)
+	go groupWorker(t, hub, "workers", joined, received)
+	<-joined
+
+	hub.PublishTo("job:1", "Hello Mike")
+	hub.PublishTo("job:1", "Hello Carol")
+	hub.RemoveSubscription("job:1")
+
+	// Nothing is lost to the dead member
+	assert.Equal(t, []string{"Hello Mike", "Hello Carol"}, <-received)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestPublishRetained(t *testing.T) {
+	hub := &Hub[string]{CommandChSize: 100}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	// Early subscriber, used to know when the hub has treated each publish
+	early, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	published := []string{"10%", "20%", "Part 1", "started", "30%"}
+	hub.PublishRetained("job:1", "complete", "10%")
+	hub.PublishRetained("job:1", "complete", "20%")
+	hub.PublishTo("job:1", "Part 1")
+	hub.PublishRetained("job:1", "phase", "started")
+	hub.PublishRetained("job:1", "complete", "30%")
+	for _, expected := range published {
+		early.ClientPing()
+		m, ok := <-early.MsgCh
+		assert.True(t, ok)
+		assert.Equal(t, expected, m)
+	}
+
+	received := make(chan []string, 1)
+	joined := make(chan Empty)
+	go groupWorker(t, hub, "", joined, received)
+	<-joined
+
+	hub.PublishTo("job:1", "Part 2")
+	early.ClientPing()
+	<-early.MsgCh
+
+	hub.RemoveSubscription("job:1")
+	early.ClientPing()
+
+	// Latest value per key, in the order keys were first retained, then live messages
+	assert.Equal(t, []string{"30%", "started", "Part 2"}, <-received)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+//
+// Runs hook once, right after the next WritingUnlock.
+//
+type hookedLocker struct {
+	RWLocker
+	hook func()
+}
+
+func (l *hookedLocker) WritingUnlock() {
+	l.RWLocker.WritingUnlock()
+	if hook := l.hook; hook != nil {
+		l.hook = nil
+		hook()
+	}
+}
+
+//
+// A subscriber that joins after a retained message is stored, but before
+// Listen() delivers it, gets it once.
+//
+func TestPublishRetainedSubscribeDuringPublish(t *testing.T) {
+	lock := &hookedLocker{RWLocker: NewRWMutexLocker(&sync.RWMutex{})}
+	hub := &Hub[string]{Lock: lock, CommandChSize: 10}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	// Listen() stores the retained value under the write lock, then
+	// subscribes this one before delivering
+	joined := make(chan *HubChannel[string], 1)
+	lock.hook = func() {
+		late, err := hub.Subscribe("job:1")
+		assert.Nil(t, err)
+		joined <- late
+	}
+	hub.PublishRetained("job:1", "complete", "50%")
+	hub.PublishTo("job:1", "Part 1")
+	hub.RemoveSubscription("job:1")
+	late := <-joined
+
+	received := []string{}
+	for {
+		late.ClientPing()
+		if m, ok := <-late.MsgCh; ok {
+			received = append(received, m)
+		} else {
+			break
+		}
+	}
+	assert.Equal(t, []string{"50%", "Part 1"}, received)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+//
+// Subscribe doesn't wait on CommandCh to have its backlog sent.
+//
+func TestSubscribeWhileHubBusy(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	// Listen() waits on this one, and CommandCh has no buffer
+	slow, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+	hub.PublishRetained("job:1", "complete", "50%")
+
+	late, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	slow.ClientPing()
+	<-slow.MsgCh
+	slow.Close()
+
+	late.ClientPing()
+	m, ok := <-late.MsgCh
+	assert.True(t, ok)
+	assert.Equal(t, "50%", m)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	late.Close()
+	<-g1
+}
+
+func TestPublishRetainedNoNewMessages(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	early, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+	hub.PublishRetained("job:1", "complete", "50%")
+	early.ClientPing()
+	<-early.MsgCh
+	early.Close()
+
+	// Retained value arrives without waiting for another publish
+	late, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+	late.ClientPing()
+	m, ok := <-late.MsgCh
+	assert.True(t, ok)
+	assert.Equal(t, "50%", m)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	late.ClientPing()
+	<-g1
+}
+
+func progressKey(m string) string {
+	if strings.HasPrefix(m, "complete:") {
+		return "complete"
+	}
+	return ""
+}
+
+func TestHubChannelOffer(t *testing.T) {
+	hCh := HubChannel[string]{}
+	hCh.Init()
+	hCh.initPump(progressKey, 0)
+
+	for i, m := range []string{"complete:10", "Part 1", "complete:20", "Part 2", "complete:30"} {
+		hCh.offer(context.Background(), hCh.pendingFor(Envelope[string]{Seq: i + 1, Message: m}))
+	}
+
+	hCh.finish(CloseFinished)
+	received := []string{}
+	seqs := []int{}
+	for {
+		queued, ok := hCh.nextPending()
+		if !ok {
+			break
+		}
+		env := queued.env
+		received = append(received, env.Message)
+		seqs = append(seqs, env.Seq)
+	}
+	assert.Equal(t, []string{"Part 1", "Part 2", "complete:30"}, received)
+	assert.Equal(t, []int{2, 4, 5}, seqs)
+}
+
+func TestConflation(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscriptionWithOpts("job:1", SubscriptionOpts[string]{Conflate: progressKey})
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	slow, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	published := []string{}
+	for i := 1; i <= 10; i++ {
+		published = append(published, fmt.Sprintf("complete:%d", i*10))
+		if i % 5 == 0 {
+			published = append(published, fmt.Sprintf("Part %d", i/5))
+		}
+	}
+	// CommandCh has no buffer, so these only return because the hub
+	// isn't waiting on the slow subscriber.
+	for _, m := range published {
+		hub.PublishTo("job:1", m)
+	}
+	hub.RemoveSubscription("job:1")
+
+	// Slow subscriber starts reading only now
+	received := []string{}
+	for {
+		slow.ClientPing()
+		if m, ok := <-slow.MsgCh; ok {
+			received = append(received, m)
+		} else {
+			break
+		}
+	}
+
+	// The pump may have taken the first message before the rest arrived
+	completes := []string{}
+	parts := []string{}
+	for _, m := range received {
+		if progressKey(m) == "" {
+			parts = append(parts, m)
+		} else {
+			completes = append(completes, m)
+		}
+	}
+	assert.Equal(t, []string{"Part 1", "Part 2"}, parts)
+	assert.LessOrEqual(t, len(completes), 2)
+	assert.Equal(t, "complete:100", completes[len(completes)-1])
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+// Keys on what comes before the colon, so "cpu:1" and "cpu:2" collapse
+func metricKey(m string) string {
+	if i := strings.Index(m, ":"); i != -1 {
+		return m[:i]
+	}
+	return ""
+}
+
+func TestConflationMaxPending(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscriptionWithOpts("job:1", SubscriptionOpts[string]{Conflate: metricKey, MaxPending: 2})
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	slow, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	// None of these collapse, so only the newest two are kept
+	for _, m := range []string{"cpu:1", "mem:1", "disk:1", "net:1", "gpu:1"} {
+		hub.PublishTo("job:1", m)
+	}
+	hub.PublishTo("job:1", "fan:1")
+	hub.RemoveSubscription("job:1")
+
+	received := []string{}
+	for {
+		slow.ClientPing()
+		if m, ok := <-slow.MsgCh; ok {
+			received = append(received, m)
+		} else {
+			break
+		}
+	}
+
+	// The pump may have taken the first message before the rest arrived
+	assert.LessOrEqual(t, len(received), 3)
+	assert.Equal(t, []string{"gpu:1", "fan:1"}, received[len(received)-2:])
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+//
+// Messages without a key are never dropped to make room. Once a slow
+// subscriber has MaxPending of them, publishing waits for it.
+//
+func TestConflationMaxPendingKeyless(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscriptionWithOpts("job:1", SubscriptionOpts[string]{Conflate: metricKey, MaxPending: 2})
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	slow, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	published := []string{"cpu:1", "Part 1", "Part 2", "Part 3", "cpu:2", "Part 4", "Part 5"}
+	g2 := make(chan Empty)
+	go func() {
+		for _, m := range published {
+			hub.PublishTo("job:1", m)
+		}
+		hub.RemoveSubscription("job:1")
+		g2 <- Em
+	}()
+
+	// Publishing is held up until the slow subscriber reads
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-g2:
+		t.Fatalf("Publishing didn't wait for the slow subscriber")
+	default:
+	}
+
+	received := []string{}
+	for {
+		slow.ClientPing()
+		if m, ok := <-slow.MsgCh; ok {
+			received = append(received, m)
+		} else {
+			break
+		}
+	}
+	<-g2
+
+	parts := []string{}
+	for _, m := range received {
+		if metricKey(m) == "" {
+			parts = append(parts, m)
+		}
+	}
+	assert.Equal(t, []string{"Part 1", "Part 2", "Part 3", "Part 4", "Part 5"}, parts)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestFirehose(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	for _, name := range []string{"job:1", "job:2", "other"} {
+		_, err := hub.CreateSubscription(name)
+		assert.Nil(t, err)
+	}
+	_, err := hub.CreateFirehose("jobs:all", "job:", 3)
+	assert.Nil(t, err)
+
+	_, err = hub.CreateFirehose("job:1", "job:", 3)
+	assert.Equal(t, errors.New("Subscription already exists with name 'job:1'"), err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	slow, err := hub.Subscribe("jobs:all")
+	assert.Nil(t, err)
+	fast, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	g2 := make(chan []string)
+	go func() {
+		received := []string{}
+		for {
+			fast.ClientPing()
+			if m, ok := <-fast.MsgCh; ok {
+				received = append(received, m)
+			} else {
+				break
+			}
+		}
+		g2 <- received
+	}()
+
+	// The firehose subscriber isn't reading, which must not hold up job:1
+	for i := 1; i <= 5; i++ {
+		hub.PublishTo("job:1", fmt.Sprintf("a%d", i))
+	}
+	hub.PublishTo("other", "ignored")
+	hub.PublishTo("job:2", "b1")
+	hub.PublishTo("job:2", "b2")
+	hub.RemoveSubscription("job:1")
+	assert.Equal(t, []string{"a1", "a2", "a3", "a4", "a5"}, <-g2)
+
+	sub := hub.GetSubscription("jobs:all")
+	assert.Equal(t, 7, sub.MessageCount)
+	assert.Equal(t, "job:", sub.Labels["firehose"])
+	assert.True(t, sub.ExpiresAt.IsZero())
+
+	hub.RemoveSubscription("jobs:all")
+	received := []string{}
+	var last Envelope[string]
+	for {
+		slow.ClientPing()
+		if m, ok := <-slow.MsgCh; ok {
+			received = append(received, m)
+			last = slow.LastEnvelope()
+		} else {
+			break
+		}
+	}
+
+	// The pump may have taken the first message before the rest arrived
+	assert.Equal(t, 7, len(received) + sub.Dropped)
+	assert.LessOrEqual(t, len(received), 4)
+	assert.Equal(t, []string{"a5", "b1", "b2"}, received[len(received)-3:])
+	assert.Equal(t, "job:2", last.Subscription)
+	assert.Equal(t, 2, last.Seq)
+	assert.Equal(t, CloseFinished, slow.Reason())
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestPublishBatch(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	err := hub.PublishBatch("job:1", []string{"Hello Mike"})
+	assert.Equal(t, errors.New("Subscription does not exist: job:1"), err)
+
+	_, err = hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	joined := make(chan Empty)
+	received := [](chan []string){}
+	for i := 0; i < 2; i++ {
+		ch := make(chan []string, 1)
+		received = append(received, ch)
+		go groupWorker(t, hub, "", joined, ch)
+		<-joined
+	}
+
+	workers := make(chan []string, 1)
+	go groupWorker(t, hub, "workers", joined, workers)
+	<-joined
+
+	batch := []string{"Part 1", "Part 2", "Part 3"}
+	assert.Nil(t, hub.PublishBatch("job:1", batch))
+	batch[0] = "Changed"
+	assert.Nil(t, hub.PublishBatch("job:1", []string{}))
+	assert.Nil(t, hub.PublishTo("job:1", "Part 4"))
+	hub.RemoveSubscription("job:1")
+
+	expected := []string{"Part 1", "Part 2", "Part 3", "Part 4"}
+	assert.Equal(t, expected, <-received[0])
+	assert.Equal(t, expected, <-received[1])
+	assert.Equal(t, expected, <-workers)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestPublishBatchCounts(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	hub.PublishBatch("job:1", []string{"Part 1", "Part 2", "Part 3"})
+	// Once this is received, the batch has been treated
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdReap}
+
+	assert.Equal(t, 3, hub.GetSubscription("job:1").MessageCount)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func benchmarkPublish(b *testing.B, batchSize int, lock RWLocker) {
+	hub := &Hub[string]{CommandChSize: 100, Lock: lock}
+	hub.Init()
+	hub.CreateSubscription("job:1")
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	readers := [](chan Empty){}
+	for i := 0; i < 4; i++ {
+		cli, _ := hub.Subscribe("job:1")
+		done := make(chan Empty)
+		readers = append(readers, done)
+		go func() {
+			for {
+				cli.ClientPing()
+				if _, ok := <-cli.MsgCh; !ok {
+					break
+				}
+			}
+			done <- Em
+		}()
+	}
+
+	batch := []string{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batchSize == 1 {
+			hub.PublishTo("job:1", "Part")
+			continue
+		}
+
+		batch = append(batch, "Part")
+		if len(batch) == batchSize || i == b.N-1 {
+			hub.PublishBatch("job:1", batch)
+			batch = batch[:0]
+		}
+	}
+	hub.RemoveSubscription("job:1")
+	for _, done := range readers {
+		<-done
+	}
+	b.StopTimer()
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func BenchmarkPublishTo(b *testing.B) {
+	benchmarkPublish(b, 1, nil)
+}
+
+func BenchmarkPublishToRWMutex(b *testing.B) {
+	benchmarkPublish(b, 1, NewRWMutexLocker(&sync.RWMutex{}))
+}
+
+func BenchmarkPublishBatch10(b *testing.B) {
+	benchmarkPublish(b, 10, nil)
+}
+
+func BenchmarkPublishBatch100(b *testing.B) {
+	benchmarkPublish(b, 100, nil)
+}
+
+//
+// Publishes to a few readers while other subscribers keep joining and
+// leaving at a steady rate. Churners filter everything out, so they're
+// never waited on.
+//
+func benchmarkPublishChurn(b *testing.B, locked bool) {
+	hub := &Hub[string]{CommandChSize: 100, LockedPublishReads: locked}
+	hub.Init()
+	hub.CreateSubscription("job:1")
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	readers := [](chan Empty){}
+	for i := 0; i < 4; i++ {
+		cli, _ := hub.Subscribe("job:1")
+		done := make(chan Empty)
+		readers = append(readers, done)
+		go func() {
+			for {
+				cli.ClientPing()
+				if _, ok := <-cli.MsgCh; !ok {
+					break
+				}
+			}
+			done <- Em
+		}()
+	}
+
+	// Paced, so both benchmarks see the same churn however fast
+	// publishing is
+	stop := make(chan Empty)
+	churners := [](chan int){}
+	for i := 0; i < 4; i++ {
+		done := make(chan int)
+		churners = append(churners, done)
+		go func() {
+			none := func(string) bool { return false }
+			ticker := time.NewTicker(100 * time.Microsecond)
+			defer ticker.Stop()
+			churns := 0
+			for {
+				select {
+				case <-stop:
+					done <- churns
+					return
+				case <-ticker.C:
+				}
+
+				cli, _ := hub.SubscribeWithOpts("job:1", SubscriberOpts[string]{Filter: none})
+				hub.removeSubscriber("job:1", cli.Id)
+				churns += 1
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hub.PublishTo("job:1", "Part")
+	}
+	b.StopTimer()
+
+	close(stop)
+	churns := 0
+	for _, done := range churners {
+		churns += <-done
+	}
+	b.ReportMetric(float64(churns) / float64(b.N), "churns/op")
+	hub.RemoveSubscription("job:1")
+	for _, done := range readers {
+		<-done
+	}
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func BenchmarkPublishChurnSnapshot(b *testing.B) {
+	benchmarkPublishChurn(b, false)
+}
+
+func BenchmarkPublishChurnLocked(b *testing.B) {
+	benchmarkPublishChurn(b, true)
+}
+
+func benchmarkSubscribersForChurn(b *testing.B, locked bool) {
+	hub := &Hub[string]{LockedPublishReads: locked}
+	hub.Init()
+	hub.CreateSubscription("job:1")
+	for i := 0; i < 16; i++ {
+		hub.Subscribe("job:1")
+	}
+
+	stop := make(chan Empty)
+	done := make(chan Empty)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				done <- Em
+				return
+			default:
+			}
+
+			cli, _ := hub.Subscribe("job:1")
+			hub.removeSubscriber("job:1", cli.Id)
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			hub.SubscribersFor("job:1")
+		}
+	})
+	b.StopTimer()
+
+	close(stop)
+	<-done
+}
+
+func BenchmarkSubscribersForChurnSnapshot(b *testing.B) {
+	benchmarkSubscribersForChurn(b, false)
+}
+
+func BenchmarkSubscribersForChurnLocked(b *testing.B) {
+	benchmarkSubscribersForChurn(b, true)
+}
+
+func TestPublishSync(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.PublishSync(context.Background(), "job:1", "Done")
+	assert.Equal(t, errors.New("Subscription does not exist: job:1"), err)
+
+	_, err = hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	joined := make(chan Empty)
+	received := make(chan []string, 1)
+	go groupWorker(t, hub, "", joined, received)
+	<-joined
+
+	dead, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+	dead.Close()
+
+	// Never pings
+	slow, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+	defer cancel()
+	report, err := hub.PublishSync(ctx, "job:1", "Done")
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Reached: 1, Dead: 1, TimedOut: 1}, report)
+
+	// Timed out subscriber is still subscribed, the dead one isn't
+	assert.Equal(t, 2, hub.GetSubscription("job:1").SubscriberCount)
+
+	hub.RemoveSubscription("job:1")
+	slow.Close()
+	assert.Equal(t, []string{"Done"}, <-received)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+//
+// Conflated subscribers count as reached only once the client has the
+// message. One still waiting when ctx is done never gets it.
+//
+func TestPublishSyncConflated(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscriptionWithOpts("job:1", SubscriptionOpts[string]{Conflate: metricKey, MaxPending: 1})
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	joined := make(chan Empty)
+	received := make(chan []string, 1)
+	go groupWorker(t, hub, "", joined, received)
+	<-joined
+
+	slow, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	// Slow's pump takes the first and waits for a ping. The second
+	// fills its queue.
+	hub.PublishTo("job:1", "cpu:1")
+	time.Sleep(10 * time.Millisecond)
+	hub.PublishTo("job:1", "mem:1")
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+	defer cancel()
+	report, err := hub.PublishSync(ctx, "job:1", "disk:1")
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Reached: 1, TimedOut: 1, Dropped: 1}, report)
+	assert.Equal(t, 1, hub.GetSubscription("job:1").Dropped)
+
+	hub.RemoveSubscription("job:1")
+	assert.Equal(t, []string{"cpu:1", "mem:1", "disk:1"}, <-received)
+
+	// mem:1 made room for disk:1, which was then withdrawn
+	slowReceived := []string{}
+	for {
+		slow.ClientPing()
+		if m, ok := <-slow.MsgCh; ok {
+			slowReceived = append(slowReceived, m)
+		} else {
+			break
+		}
+	}
+	assert.Equal(t, []string{"cpu:1"}, slowReceived)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestPublishSyncCancelledBeforeQueued(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	// Nobody is listening, so the command can't be queued
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = hub.PublishSync(ctx, "job:1", "Done")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestPublishSyncAfterShutdown(t *testing.T) {
+	hub := &Hub[string]{CommandChSize: 1}
+	hub.Init()
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	// Queued, but nobody will treat it
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	_, err = hub.PublishSync(ctx, "job:1", "Done")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestPublishSyncBehindBlockedPublish(t *testing.T) {
+	hub := &Hub[string]{CommandChSize: 1}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	// Never pings, so Listen() waits on it for the plain publish
+	slow, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+	hub.PublishTo("job:1", "Part 1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	_, err = hub.PublishSync(ctx, "job:1", "Done")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	slow.Close()
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestTryPublish(t *testing.T) {
+	hub := &Hub[string]{CommandChSize: 1}
+	hub.Init()
+
+	err := hub.TryPublish("job:1", "Hello Mike")
+	assert.Equal(t, errors.New("Subscription does not exist: job:1"), err)
+
+	_, err = hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	// Nobody is listening, so only the buffer has room
+	assert.Nil(t, hub.TryPublish("job:1", "Hello Mike"))
+	assert.Equal(t, ErrHubBusy, hub.TryPublish("job:1", "Hello Carol"))
+
+	cmd := <-hub.CommandCh
+	assert.Equal(t, "Hello Mike", cmd.Message)
+	assert.Nil(t, hub.TryPublish("job:1", "Hello Carol"))
+}
+
+func TestTryPublishRetained(t *testing.T) {
+	hub := &Hub[string]{CommandChSize: 1}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	assert.Nil(t, hub.TryPublishRetained("job:1", "complete", "complete:10"))
+	assert.Equal(t, ErrHubBusy, hub.TryPublishRetained("job:1", "complete", "complete:20"))
+
+	cmd := <-hub.CommandCh
+	assert.Equal(t, "complete:10", cmd.Message)
+	assert.Equal(t, "complete", cmd.RetainKey)
+}
+
+func TestPublishTimeout(t *testing.T) {
+	hub := &Hub[string]{CommandChSize: 1}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	wait, _ := time.ParseDuration("10ms")
+	assert.Nil(t, hub.PublishTimeout("job:1", "Hello Mike", wait))
+	assert.Equal(t, ErrHubBusy, hub.PublishTimeout("job:1", "Hello Carol", wait))
+
+	// Room frees up while waiting
+	go func() {
+		time.Sleep(wait)
+		<-hub.CommandCh
+	}()
+	assert.Nil(t, hub.PublishTimeout("job:1", "Hello Carol", time.Second))
+}
+
+func TestSubscriberFilter(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	onlyParts := func(m string) bool { return strings.HasPrefix(m, "Part") }
+	hub.PublishRetained("job:1", "complete", "complete:10")
+	hub.PublishRetained("job:1", "last", "Part 0")
+
+	cli, err := hub.SubscribeWithOpts("job:1", SubscriberOpts[string]{Filter: onlyParts})
+	assert.Nil(t, err)
+
+	received := make(chan []string, 1)
+	go func() {
+		messages := []string{}
+		for {
+			cli.ClientPing()
+			if m, ok := <-cli.MsgCh; ok {
+				messages = append(messages, m)
+			} else {
+				break
+			}
+		}
+		received <- messages
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	report, err := hub.PublishSync(ctx, "job:1", "complete:20")
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Filtered: 1}, report)
+
+	hub.PublishBatch("job:1", []string{"Part 1", "complete:30", "Part 2"})
+	hub.RemoveSubscription("job:1")
+
+	// Retained messages are filtered too
+	assert.Equal(t, []string{"Part 0", "Part 1", "Part 2"}, <-received)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+//
+// A group message counts once: as reached if any member takes it, and
+// as filtered only if every member filters it.
+//
+func TestQueueGroupFilter(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	// First in line, but only wants parts
+	onlyParts := func(m string) bool { return strings.HasPrefix(m, "Part") }
+	picky, err := hub.SubscribeWithOpts("job:1", SubscriberOpts[string]{Group: "workers", Filter: onlyParts})
+	assert.Nil(t, err)
+	onlyCompletes := func(m string) bool { return strings.HasPrefix(m, "complete:") }
+	other, err := hub.SubscribeWithOpts("job:1", SubscriberOpts[string]{Group: "workers", Filter: onlyCompletes})
+	assert.Nil(t, err)
+
+	received := make(chan []string, 1)
+	go func() {
+		messages := []string{}
+		for {
+			other.ClientPing()
+			if m, ok := <-other.MsgCh; ok {
+				messages = append(messages, m)
+			} else {
+				break
+			}
+		}
+		received <- messages
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	report, err := hub.PublishSync(ctx, "job:1", "complete:10")
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Reached: 1}, report)
+
+	report, err = hub.PublishSync(ctx, "job:1", "Hello Mike")
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Filtered: 1}, report)
+
+	picky.Close()
+	hub.RemoveSubscription("job:1")
+	assert.Equal(t, []string{"complete:10"}, <-received)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestPublishInterceptors(t *testing.T) {
+	audit := []string{}
+	hub := &Hub[string]{CommandChSize: 10}
+	hub.PublishInterceptors = []PublishInterceptor[string]{
+		func(name string, m string) (string, error) {
+			if m == "" {
+				return m, errors.New("Empty message")
+			}
+			return strings.ReplaceAll(m, "hunter2", "[REDACTED]"), nil
+		},
+		func(name string, m string) (string, error) {
+			audit = append(audit, name + ": " + m)
+			return m, nil
+		},
+	}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	// Interceptors don't see publishes to missing subscriptions
+	assert.NotNil(t, hub.PublishTo("job:2", "Hello"))
+
+	assert.Nil(t, hub.PublishTo("job:1", "password=hunter2"))
+	assert.Equal(t, errors.New("Empty message"), hub.PublishTo("job:1", ""))
+	assert.Equal(t, errors.New("Empty message"), hub.PublishBatch("job:1", []string{"Part 1", ""}))
+
+	batch := []string{"Part 1", "token hunter2"}
+	assert.Nil(t, hub.PublishBatch("job:1", batch))
+	assert.Equal(t, "token hunter2", batch[1])
+
+	cmd := <-hub.CommandCh
+	assert.Equal(t, "password=[REDACTED]", cmd.Message)
+	cmd = <-hub.CommandCh
+	assert.Equal(t, []string{"Part 1", "token [REDACTED]"}, cmd.Messages)
+	assert.Empty(t, hub.CommandCh)
+
+	// Rejected batch never reached the audit
+	assert.Equal(t, []string{"job:1: password=[REDACTED]", "job:1: Part 1", "job:1: token [REDACTED]"}, audit)
+}
+
+func TestSubscribeInterceptors(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.SubscribeInterceptors = []SubscribeInterceptor[string]{
+		func(name string, opts *SubscriberOpts[string]) error {
+			if opts.Meta["user"] != "mike" {
+				return errors.New("Access denied")
+			}
+			opts.Meta["checked"] = "true"
+			return nil
+		},
+	}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	_, err = hub.SubscribeWithOpts("job:1", SubscriberOpts[string]{Meta: map[string]string{"user": "carol"}})
+	assert.Equal(t, errors.New("Access denied"), err)
+	_, err = hub.Subscribe("job:1")
+	assert.Equal(t, errors.New("Access denied"), err)
+
+	cli, err := hub.SubscribeWithOpts("job:1", SubscriberOpts[string]{Meta: map[string]string{"user": "mike"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "true", cli.Meta["checked"])
+	assert.Equal(t, 1, hub.GetSubscription("job:1").SubscriberCount)
+}
+
+func TestEnvelope(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	hub := &Hub[string]{Now: func() time.Time { return now }}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	err = hub.PublishWithOpts("job:2", "Hello Mike", PublishOpts{})
+	assert.Equal(t, errors.New("Subscription does not exist: job:2"), err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	cli, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	envelopes := make(chan []Envelope[string], 1)
+	go func() {
+		received := []Envelope[string]{}
+		for {
+			cli.ClientPing()
+			m, ok := <-cli.MsgCh
+			if !ok {
+				break
+			}
+			env := cli.LastEnvelope()
+			assert.Equal(t, m, env.Message)
+			received = append(received, env)
+		}
+		envelopes <- received
+	}()
+
+	headers := map[string]string{"trace": "abc"}
+	hub.PublishWithOpts("job:1", "Hello Mike", PublishOpts{PublisherId: "runner-1", Headers: headers})
+	headers["trace"] = "changed"
+	hub.PublishBatch("job:1", []string{"Part 1", "Part 2"})
+	hub.PublishTo("job:1", "Hello Carol")
+	hub.RemoveSubscription("job:1")
+
+	received := <-envelopes
+	assert.Equal(t, 4, len(received))
+
+	ids := map[string]bool{}
+	for i, env := range received {
+		assert.Equal(t, "job:1", env.Subscription)
+		assert.Equal(t, i + 1, env.Seq)
+		assert.Equal(t, now, env.PublishedAt)
+		ids[env.Id] = true
+	}
+	assert.Equal(t, 4, len(ids))
+
+	assert.Equal(t, "runner-1", received[0].PublisherId)
+	assert.Equal(t, map[string]string{"trace": "abc"}, received[0].Headers)
+	assert.Equal(t, []string{"Hello Mike", "Part 1", "Part 2", "Hello Carol"}, []string{received[0].Message, received[1].Message, received[2].Message, received[3].Message})
+	assert.Equal(t, "", received[3].PublisherId)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestEnvelopeRetained(t *testing.T) {
+	hub := &Hub[string]{}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	hub.PublishTo("job:1", "Part 1")
+	hub.PublishRetained("job:1", "complete", "complete:50")
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdReap}
+
+	cli, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	// Retained message keeps its original envelope
+	cli.ClientPing()
+	m, ok := <-cli.MsgCh
+	assert.True(t, ok)
+	assert.Equal(t, "complete:50", m)
+	assert.Equal(t, 2, cli.LastEnvelope().Seq)
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	cli.ClientPing()
+	<-g1
+}
+
+func TestCloseReason(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	hub := &Hub[string]{Now: func() time.Time { return now }, MaxLifetime: time.Hour}
+	hub.Init()
+
+	for _, name := range []string{"job:1", "job:2", "job:3"} {
+		_, err := hub.CreateSubscription(name)
+		assert.Nil(t, err)
+	}
+	_, err := hub.CreateSubscriptionWithOpts("job:4", SubscriptionOpts[string]{Conflate: progressKey})
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	waitForClose := func(cli *HubChannel[string]) CloseReason {
+		for {
+			cli.ClientPing()
+			if _, ok := <-cli.MsgCh; !ok {
+				return cli.Reason()
+			}
+		}
+	}
+
+	cli1, _ := hub.Subscribe("job:1")
+	cli2, _ := hub.Subscribe("job:2")
+	cli3, _ := hub.Subscribe("job:3")
+	cli4, _ := hub.Subscribe("job:4")
+
+	hub.RemoveSubscription("job:1")
+	assert.Equal(t, CloseFinished, waitForClose(cli1))
+
+	hub.RemoveSubscriptionWithReason("job:2", CloseFailed)
+	assert.Equal(t, CloseFailed, waitForClose(cli2))
+
+	// Conflated subscribers get the reason through their pump
+	hub.PublishTo("job:4", "complete:10")
+	hub.RemoveSubscriptionWithReason("job:4", CloseCancelled)
+	assert.Equal(t, CloseCancelled, waitForClose(cli4))
+
+	now = now.Add(time.Hour)
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdReap}
+	assert.Equal(t, CloseReaped, waitForClose(cli3))
+
+	_, err = hub.CreateSubscription("job:5")
+	assert.Nil(t, err)
+	cli5, _ := hub.Subscribe("job:5")
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	assert.Equal(t, CloseShutdown, waitForClose(cli5))
+	<-g1
+}
+
 func TestCommandCh(t *testing.T) {
 	hub := &Hub[string]{}
 	hub.Init()
@@ -152,6 +1784,40 @@ func TestGetSubscribers(t *testing.T) {
 	}
 }
 
+func TestSubscriberSnapshot(t *testing.T) {
+	for _, locked := range []bool{false, true} {
+		hub := &Hub[string]{LockedPublishReads: locked}
+		hub.Init()
+
+		_, err := hub.CreateSubscription("job:1")
+		assert.Nil(t, err)
+		_, err = hub.CreateSubscription("job:2")
+		assert.Nil(t, err)
+
+		cli1, _ := hub.Subscribe("job:1")
+		cli2, _ := hub.Subscribe("job:1")
+		cli3, _ := hub.Subscribe("job:2")
+
+		before := hub.SubscribersFor("job:1")
+		assert.Nil(t, hub.removeSubscriber("job:1", cli1.Id))
+
+		// What was read before is left alone
+		assert.Equal(t, []*HubChannel[string]{cli1, cli2}, before)
+		assert.Equal(t, []*HubChannel[string]{cli2}, hub.SubscribersFor("job:1"))
+		assert.Equal(t, []*HubChannel[string]{cli3}, hub.SubscribersFor("job:2"))
+
+		// Appending to what was read doesn't reach the hub
+		_ = append(hub.SubscribersFor("job:1"), cli3)
+		assert.Equal(t, []*HubChannel[string]{cli2}, hub.SubscribersFor("job:1"))
+
+		cli2.Close()
+		cli3.Close()
+		assert.Nil(t, hub.removeSubscription("job:1", false, CloseFinished))
+		assert.Empty(t, hub.SubscribersFor("job:1"))
+		assert.Equal(t, []*HubChannel[string]{cli3}, hub.SubscribersFor("job:2"))
+	}
+}
+
 func TestRemoveSubscriber(t *testing.T) {
 	hub := &Hub[string]{}
 	hub.Init()
@@ -186,6 +1852,44 @@ func TestRemoveSubscriber(t *testing.T) {
 	assert.Empty(t, subscribersAfter)
 }
 
+func TestRemoveSubscriberRWMutex(t *testing.T) {
+	hub := &Hub[string]{Lock: NewRWMutexLocker(&sync.RWMutex{})}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+
+	dead, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+	dead.Close()
+
+	cli, err := hub.Subscribe("job:1")
+	assert.Nil(t, err)
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	g2 := make(chan string)
+	go func() {
+		cli.ClientPing()
+		g2 <- <-cli.MsgCh
+	}()
+
+	hub.PublishTo("job:1", "Hello")
+	assert.Equal(t, "Hello", <-g2)
+
+	// Dead subscriber was removed, and removing one that's gone is fine
+	assert.Equal(t, []*HubChannel[string]{cli}, hub.SubscribersFor("job:1"))
+	assert.Nil(t, hub.removeSubscriber("job:1", "missing"))
+
+	hub.CommandCh <- HubCommand[string]{CmdType: HubCmdShutdown}
+	cli.ClientPing()
+	<-g1
+}
+
 func TestPublishToNonexistent(t *testing.T) {
 	hub := &Hub[string]{}
 	hub.Init()
@@ -0,0 +1,137 @@
+package pkg
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+//
+// Who is holding a lock, passed to ReadWriteLock.OnLongHold.
+//
+type LockHolder struct {
+	Goroutine int64
+	Write bool
+	Upgradable bool
+	Since time.Time
+	Stack string
+}
+
+//
+// Catches lock misuse when Debug is on. Every lock must be released by
+// the goroutine that acquired it.
+//
+type lockChecker struct {
+	mu semaphore
+	holders map[int64]*heldLock
+	longHold time.Duration
+	onLongHold func(LockHolder)
+}
+
+type heldLock struct {
+	holder LockHolder
+	timer *time.Timer
+}
+
+func newLockChecker(longHold time.Duration, onLongHold func(LockHolder)) *lockChecker {
+	if onLongHold == nil {
+		onLongHold = printLongHold
+	}
+	return &lockChecker{mu: make(semaphore, 1), holders: map[int64]*heldLock{}, longHold: longHold, onLongHold: onLongHold}
+}
+
+func printLongHold(holder LockHolder) {
+	fmt.Printf("Lock held for %s since %s by goroutine %d, acquired at:\n%s\n", holder.mode(), holder.Since.Format(time.RFC3339Nano), holder.Goroutine, holder.Stack)
+}
+
+func lockMode(write bool, upgradable bool) string {
+	if write {
+		return "writing"
+	}
+	if upgradable {
+		return "upgradable reading"
+	}
+	return "reading"
+}
+
+func (holder LockHolder) mode() string {
+	return lockMode(holder.Write, holder.Upgradable)
+}
+
+//
+// Called before waiting, since waiting on a lock the goroutine already
+// holds for writing would never return. Attempts that don't wait get
+// false instead.
+//
+func (c *lockChecker) acquiring(write bool, wait bool) bool {
+	gid := goroutineId()
+
+	c.mu.P()
+	held, ok := c.holders[gid]
+	c.mu.V()
+
+	if ok && !wait {
+		return false
+	}
+	if ok {
+		panic(fmt.Sprintf("Goroutine %d is locking for %s while it already holds the lock for %s\n\nAlready acquired at:\n%s\nAcquiring again at:\n%s", gid, lockMode(write, false), held.holder.mode(), held.holder.Stack, debug.Stack()))
+	}
+	return true
+}
+
+func (c *lockChecker) acquired(write bool) {
+	held := &heldLock{holder: LockHolder{Goroutine: goroutineId(), Write: write, Since: time.Now(), Stack: string(debug.Stack())}}
+	if c.longHold > 0 {
+		holder := held.holder
+		held.timer = time.AfterFunc(c.longHold, func() { c.onLongHold(holder) })
+	}
+
+	c.mu.P()
+	c.holders[held.holder.Goroutine] = held
+	c.mu.V()
+}
+
+func (c *lockChecker) markUpgradable() {
+	gid := goroutineId()
+
+	c.mu.P()
+	if held, ok := c.holders[gid]; ok {
+		held.holder.Upgradable = true
+	}
+	c.mu.V()
+}
+
+func (c *lockChecker) releasing(write bool, upgradable bool) {
+	held := c.holding(write, upgradable)
+
+	c.mu.P()
+	delete(c.holders, held.holder.Goroutine)
+	c.mu.V()
+
+	if held.timer != nil {
+		held.timer.Stop()
+	}
+}
+
+//
+// Panics unless the goroutine holds the lock in the given mode. Called
+// before unlocking, and before upgrading since an upgrade starts by
+// leaving the readers.
+//
+func (c *lockChecker) holding(write bool, upgradable bool) *heldLock {
+	gid := goroutineId()
+	mode := lockMode(write, upgradable)
+
+	c.mu.P()
+	held, ok := c.holders[gid]
+	c.mu.V()
+
+	if !ok {
+		panic(fmt.Sprintf("Goroutine %d is unlocking for %s without holding the lock\n\nUnlocking at:\n%s", gid, mode, debug.Stack()))
+	}
+
+	if held.holder.mode() != mode {
+		panic(fmt.Sprintf("Goroutine %d is unlocking for %s but holds the lock for %s\n\nAcquired at:\n%s\nUnlocking at:\n%s", gid, mode, held.holder.mode(), held.holder.Stack, debug.Stack()))
+	}
+	return held
+}
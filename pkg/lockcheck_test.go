@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCheckedLock(longHold time.Duration, onLongHold func(LockHolder)) *ReadWriteLock {
+	wasDebug := Debug
+	Debug = true
+	lock := &ReadWriteLock{LongHold: longHold, OnLongHold: onLongHold}
+	lock.Init()
+	Debug = wasDebug
+	return lock
+}
+
+func panicMessage(f func()) (msg string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg = r.(string)
+		}
+	}()
+	f()
+	return ""
+}
+
+func lockTwice(lock *ReadWriteLock) {
+	lock.LockForWriting()
+	lock.LockForReading()
+}
+
+func TestLockCheckReentrant(t *testing.T) {
+	lock := newCheckedLock(0, nil)
+
+	msg := panicMessage(func() { lockTwice(lock) })
+	assert.True(t, strings.Contains(msg, "is locking for reading while it already holds the lock for writing"), msg)
+
+	// Both stacks point at lockTwice
+	assert.Equal(t, 2, strings.Count(msg, "lockTwice("), msg)
+	lock.WritingUnlock()
+
+	// Attempts that don't wait just fail
+	lock.LockForReading()
+	assert.False(t, lock.TryLockForReading())
+	assert.False(t, lock.TryLockForWriting())
+	lock.ReadingUnlock()
+}
+
+func TestLockCheckUnlockWithoutLock(t *testing.T) {
+	lock := newCheckedLock(0, nil)
+
+	msg := panicMessage(func() { lock.WritingUnlock() })
+	assert.True(t, strings.Contains(msg, "is unlocking for writing without holding the lock"), msg)
+
+	// Held, but by someone else
+	g1 := make(chan Empty)
+	go func() {
+		lock.LockForReading()
+		g1 <- Em
+		<-g1
+		lock.ReadingUnlock()
+		g1 <- Em
+	}()
+	<-g1
+	msg = panicMessage(func() { lock.ReadingUnlock() })
+	assert.True(t, strings.Contains(msg, "is unlocking for reading without holding the lock"), msg)
+	g1 <- Em
+	<-g1
+}
+
+func TestLockCheckMixUp(t *testing.T) {
+	lock := newCheckedLock(0, nil)
+
+	lock.LockForReading()
+	msg := panicMessage(func() { lock.WritingUnlock() })
+	assert.True(t, strings.Contains(msg, "is unlocking for writing but holds the lock for reading"), msg)
+	assert.True(t, strings.Contains(msg, "Acquired at:"), msg)
+
+	// Still held for reading
+	assert.Equal(t, 1, lock.ReaderCount)
+	lock.ReadingUnlock()
+	assert.True(t, lock.TryLockForWriting())
+	lock.WritingUnlock()
+}
+
+func TestLockCheckLongHold(t *testing.T) {
+	reports := make(chan LockHolder, 10)
+	lock := newCheckedLock(10 * time.Millisecond, func(holder LockHolder) {
+		reports <- holder
+	})
+
+	// Released in time
+	lock.LockForReading()
+	lock.ReadingUnlock()
+
+	lock.LockForWriting()
+	holder := <-reports
+	lock.WritingUnlock()
+
+	assert.True(t, holder.Write)
+	assert.Equal(t, goroutineId(), holder.Goroutine)
+	assert.True(t, strings.Contains(holder.Stack, "TestLockCheckLongHold"))
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, len(reports))
+}
+
+func TestLockCheckUpgrade(t *testing.T) {
+	lock := newCheckedLock(0, nil)
+
+	lock.LockForReading()
+	msg := panicMessage(func() { lock.UpgradeToWriting() })
+	assert.True(t, strings.Contains(msg, "is unlocking for upgradable reading but holds the lock for reading"), msg)
+	lock.ReadingUnlock()
+
+	lock.LockForUpgradableReading()
+	msg = panicMessage(func() { lock.ReadingUnlock() })
+	assert.True(t, strings.Contains(msg, "is unlocking for reading but holds the lock for upgradable reading"), msg)
+	lock.UpgradeToWriting()
+	lock.WritingUnlock()
+	assert.True(t, lock.TryLockForWriting())
+	lock.WritingUnlock()
+
+	// Still held for upgradable reading after a failed attempt
+	lock.LockForUpgradableReading()
+	g1 := make(chan Empty)
+	go func() {
+		lock.LockForReading()
+		g1 <- Em
+		<-g1
+		lock.ReadingUnlock()
+		g1 <- Em
+	}()
+	<-g1
+	assert.False(t, lock.TryUpgradeToWriting())
+	g1 <- Em
+	<-g1
+	assert.True(t, lock.TryUpgradeToWriting())
+	lock.WritingUnlock()
+}
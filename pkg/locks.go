@@ -1,14 +1,93 @@
-
 package pkg
 
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
 type semaphore chan Empty
+
+//
+// Who goes first when readers and writers are both waiting.
+//
+type LockPolicy int
+
+const (
+	// Readers and writers are served in the order they arrive.
+	LockPolicyFair LockPolicy = iota
+
+	// New readers join current ones, even if a writer is waiting.
+	// Writers can starve while readers overlap.
+	LockPolicyReaderPreferring
+
+	// Waiting writers go ahead of new readers. Readers can starve
+	// while writers keep arriving.
+	LockPolicyWriterPreferring
+)
+
+//
+// What Hub needs from its lock. ReadWriteLock implements it, and
+// NewRWMutexLocker wraps a sync.RWMutex.
+//
+type RWLocker interface {
+	LockForReading()
+	ReadingUnlock()
+	LockForWriting()
+	WritingUnlock()
+}
+
+//
+// Locks that can also upgrade a read to a write, like ReadWriteLock.
+//
+type UpgradableRWLocker interface {
+	RWLocker
+	LockForUpgradableReading()
+	UpgradableReadingUnlock()
+	UpgradeToWriting()
+}
+
 type ReadWriteLock struct {
+	// Set before Init. Defaults to LockPolicyFair.
+	Policy LockPolicy
+
+	// Set before Init to record what Stats() returns. Costs a stack
+	// lookup on every lock and unlock.
+	Instrumented bool
+	recorder *lockRecorder
+
+	// With Debug on at Init, misuse panics with the stack traces involved,
+	// and OnLongHold is called for anyone holding the lock longer than
+	// LongHold. OnLongHold defaults to printing the holder's stack.
+	LongHold time.Duration
+	OnLongHold func(LockHolder)
+	checker *lockChecker
+
+	// Turnstile that readers pass through. Writers hold it while
+	// waiting unless readers are preferred.
 	ServiceQueue semaphore
 	ReaderCountLock semaphore
 	ReaderCount int
 	ResourceLock semaphore
+
+	// Used when writers are preferred. The first waiting writer closes
+	// ServiceQueue to new readers and the last one out opens it.
+	WriterCountLock semaphore
+	WriterCount int
+
+	// Held by writers and by the one upgradable reader, so nobody can
+	// write between an upgradable read and its upgrade.
+	UpgradeLock semaphore
+
+	// Fair policy only. Holds a token while a writer has ServiceQueue and
+	// waits on UpgradeLock. An upgrading reader takes the token instead
+	// of ServiceQueue, since new readers are already held back for it.
+	TurnstileHeld semaphore
 }
 
+var errWouldBlock = errors.New("Lock is not available")
+
 func (s semaphore) P() {
 	s <- Empty{}
 }
@@ -17,38 +96,567 @@ func (s semaphore) V() {
 	<-s
 }
 
+func (s semaphore) tryP() bool {
+	select {
+	case s <- Empty{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s semaphore) pCtx(ctx context.Context) error {
+	select {
+	case s <- Empty{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//
+// How a lock method waits on each semaphore: forever, not at all, or
+// until a context is done.
+//
+type acquirer func(semaphore) error
+
+func acquireBlocking(s semaphore) error {
+	s.P()
+	return nil
+}
+
+func acquireTry(s semaphore) error {
+	if !s.tryP() {
+		return errWouldBlock
+	}
+	return nil
+}
+
+func acquireCtx(ctx context.Context) acquirer {
+	return func(s semaphore) error {
+		return s.pCtx(ctx)
+	}
+}
+
 func (rw *ReadWriteLock) Init() {
 	rw.ServiceQueue = make(semaphore, 1)
 	rw.ReaderCountLock = make(semaphore, 1)
 	rw.ResourceLock = make(semaphore, 1)
+	rw.WriterCountLock = make(semaphore, 1)
+	rw.UpgradeLock = make(semaphore, 1)
+	rw.TurnstileHeld = make(semaphore, 1)
+	if rw.Instrumented {
+		rw.recorder = newLockRecorder()
+	}
+	if Debug {
+		rw.checker = newLockChecker(rw.LongHold, rw.OnLongHold)
+	}
+}
+
+//
+// Counts and timings since Init. Returns false unless Instrumented
+// was set.
+//
+func (rw *ReadWriteLock) Stats() (LockStats, bool) {
+	if rw.recorder == nil {
+		return LockStats{}, false
+	}
+	return rw.recorder.snapshot(), true
+}
+
+//
+// Called by the public lock methods before waiting. Returns when
+// waiting started.
+//
+func (rw *ReadWriteLock) acquiring(write bool) time.Time {
+	if rw.checker != nil {
+		rw.checker.acquiring(write, true)
+	}
+	return time.Now()
+}
+
+//
+// Like acquiring, for attempts that don't wait. Returns false if the
+// goroutine already holds the lock, in which case the attempt fails
+// like it would on a busy lock.
+//
+func (rw *ReadWriteLock) tryAcquiring(write bool) (time.Time, bool) {
+	if rw.checker != nil && !rw.checker.acquiring(write, false) {
+		return time.Time{}, false
+	}
+	return time.Now(), true
+}
+
+//
+// Records a successful acquisition by whoever called the public
+// lock method.
+//
+func (rw *ReadWriteLock) acquired(write bool, start time.Time) {
+	if rw.checker != nil {
+		rw.checker.acquired(write)
+	}
+	if rw.recorder != nil {
+		rw.recorder.acquired(write, time.Since(start), callSite())
+	}
+}
+
+func (rw *ReadWriteLock) releasing(write bool, upgradable bool) {
+	if rw.checker != nil {
+		rw.checker.releasing(write, upgradable)
+	}
+	if rw.recorder != nil {
+		rw.recorder.released(write)
+	}
 }
 
 func (rw *ReadWriteLock) LockForWriting() {
-	rw.ServiceQueue.P()
-	rw.ResourceLock.P()
-	rw.ServiceQueue.V()
+	start := rw.acquiring(true)
+	rw.lockForWriting(acquireBlocking)
+	rw.acquired(true, start)
+}
+
+//
+// Like LockForWriting, but returns false right away instead of waiting.
+//
+func (rw *ReadWriteLock) TryLockForWriting() bool {
+	start, ok := rw.tryAcquiring(true)
+	if !ok || rw.lockForWriting(acquireTry) != nil {
+		return false
+	}
+	rw.acquired(true, start)
+	return true
+}
+
+//
+// Like LockForWriting, but gives up when ctx is done. The lock is
+// left as it was and ctx.Err() is returned.
+//
+func (rw *ReadWriteLock) LockForWritingCtx(ctx context.Context) error {
+	start := rw.acquiring(true)
+	if err := rw.lockForWriting(acquireCtx(ctx)); err != nil {
+		return err
+	}
+	rw.acquired(true, start)
+	return nil
+}
+
+func (rw *ReadWriteLock) lockForWriting(acquire acquirer) error {
+	switch rw.Policy {
+	case LockPolicyReaderPreferring:
+		if err := acquire(rw.UpgradeLock); err != nil {
+			return err
+		}
+
+		if err := acquire(rw.ResourceLock); err != nil {
+			rw.UpgradeLock.V()
+			return err
+		}
+		return nil
+	case LockPolicyWriterPreferring:
+		// Count as waiting before anything else so new readers
+		// are held back
+		if err := rw.joinWriters(acquire); err != nil {
+			return err
+		}
+
+		if err := acquire(rw.UpgradeLock); err != nil {
+			rw.leaveWriters()
+			return err
+		}
+
+		if err := acquire(rw.ResourceLock); err != nil {
+			rw.UpgradeLock.V()
+			rw.leaveWriters()
+			return err
+		}
+		return nil
+	default:
+		// Line up with readers first, so they're served in order
+		if err := acquire(rw.ServiceQueue); err != nil {
+			return err
+		}
+
+		if err := rw.acquireUpgradeLock(acquire); err != nil {
+			rw.ServiceQueue.V()
+			return err
+		}
+
+		if err := acquire(rw.ResourceLock); err != nil {
+			rw.UpgradeLock.V()
+			rw.ServiceQueue.V()
+			return err
+		}
+		rw.ServiceQueue.V()
+		return nil
+	}
+}
+
+//
+// Waits for UpgradeLock while holding ServiceQueue. If an upgradable
+// reader has it, that reader can't take ServiceQueue to upgrade, so it's
+// left a token in TurnstileHeld instead.
+//
+func (rw *ReadWriteLock) acquireUpgradeLock(acquire acquirer) error {
+	if rw.UpgradeLock.tryP() {
+		return nil
+	}
+
+	// Nobody else can hold ServiceQueue, so a token left here is from
+	// an upgrade that failed after an earlier writer gave up
+	select {
+	case <-rw.TurnstileHeld:
+	default:
+	}
+	rw.TurnstileHeld.P()
+	err := acquire(rw.UpgradeLock)
+
+	// Take the token back if nobody upgraded
+	select {
+	case <-rw.TurnstileHeld:
+	default:
+	}
+	return err
 }
 
 func (rw *ReadWriteLock) WritingUnlock() {
+	rw.releasing(true, false)
 	rw.ResourceLock.V()
+	if rw.Policy == LockPolicyWriterPreferring {
+		rw.leaveWriters()
+	}
+	rw.UpgradeLock.V()
+}
+
+func (rw *ReadWriteLock) joinWriters(acquire acquirer) error {
+	if err := acquire(rw.WriterCountLock); err != nil {
+		return err
+	}
+
+	rw.WriterCount += 1
+	if rw.WriterCount == 1 {
+		if err := acquire(rw.ServiceQueue); err != nil {
+			rw.WriterCount -= 1
+			rw.WriterCountLock.V()
+			return err
+		}
+	}
+	rw.WriterCountLock.V()
+	return nil
+}
+
+func (rw *ReadWriteLock) leaveWriters() {
+	rw.WriterCountLock.P()
+	rw.WriterCount -= 1
+	if rw.WriterCount == 0 {
+		rw.ServiceQueue.V()
+	}
+	rw.WriterCountLock.V()
 }
 
 func (rw *ReadWriteLock) LockForReading() {
-	rw.ServiceQueue.P()
-	rw.ReaderCountLock.P()
+	start := rw.acquiring(false)
+	rw.lockForReading(acquireBlocking)
+	rw.acquired(false, start)
+}
+
+//
+// Like LockForReading, but returns false right away instead of waiting.
+//
+func (rw *ReadWriteLock) TryLockForReading() bool {
+	start, ok := rw.tryAcquiring(false)
+	if !ok || rw.lockForReading(acquireTry) != nil {
+		return false
+	}
+	rw.acquired(false, start)
+	return true
+}
+
+//
+// Like LockForReading, but gives up when ctx is done. The lock is
+// left as it was and ctx.Err() is returned. ReaderCount only goes up
+// once the lock is held.
+//
+func (rw *ReadWriteLock) LockForReadingCtx(ctx context.Context) error {
+	start := rw.acquiring(false)
+	if err := rw.lockForReading(acquireCtx(ctx)); err != nil {
+		return err
+	}
+	rw.acquired(false, start)
+	return nil
+}
+
+func (rw *ReadWriteLock) lockForReading(acquire acquirer) error {
+	return rw.joinReaders(acquire, rw.Policy != LockPolicyReaderPreferring)
+}
+
+func (rw *ReadWriteLock) joinReaders(acquire acquirer, turnstile bool) error {
+	if turnstile {
+		if err := acquire(rw.ServiceQueue); err != nil {
+			return err
+		}
+	}
+
+	if err := acquire(rw.ReaderCountLock); err != nil {
+		if turnstile {
+			rw.ServiceQueue.V()
+		}
+		return err
+	}
+	if rw.ReaderCount == 0 {
+		if err := acquire(rw.ResourceLock); err != nil {
+			if turnstile {
+				rw.ServiceQueue.V()
+			}
+			rw.ReaderCountLock.V()
+			return err
+		}
+	}
 	rw.ReaderCount += 1
-	if rw.ReaderCount == 1 {
-		rw.ResourceLock.P()
+	if rw.recorder != nil {
+		rw.recorder.readers(rw.ReaderCount)
+	}
+	if turnstile {
+		rw.ServiceQueue.V()
 	}
-	rw.ServiceQueue.V()
 	rw.ReaderCountLock.V()
+	return nil
 }
 
 func (rw *ReadWriteLock) ReadingUnlock() {
+	rw.releasing(false, false)
+	rw.unlockReading()
+}
+
+func (rw *ReadWriteLock) unlockReading() {
 	rw.ReaderCountLock.P()
 	rw.ReaderCount -= 1
 	if rw.ReaderCount == 0 {
 		rw.ResourceLock.V()
 	}
-	rw.ReaderCountLock.V()	
+	rw.ReaderCountLock.V()
+}
+
+//
+// Reads alongside plain readers, but only one upgradable reader is let
+// in at a time and writers wait for it. Release it with
+// UpgradableReadingUnlock, or call UpgradeToWriting and later
+// WritingUnlock.
+//
+func (rw *ReadWriteLock) LockForUpgradableReading() {
+	start := rw.acquiring(false)
+	rw.UpgradeLock.P()
+
+	// No writer can hold the resource now, and a waiting writer may be
+	// holding the turnstile, so skip it
+	rw.joinReaders(acquireBlocking, false)
+	rw.acquired(false, start)
+	if rw.checker != nil {
+		rw.checker.markUpgradable()
+	}
+}
+
+func (rw *ReadWriteLock) UpgradableReadingUnlock() {
+	rw.releasing(false, true)
+	rw.unlockReading()
+	rw.UpgradeLock.V()
+}
+
+//
+// Turns an upgradable read into a write once the other readers are
+// done. No writer can get in between, so whatever was read still holds.
+//
+func (rw *ReadWriteLock) UpgradeToWriting() {
+	start := rw.upgrading()
+	rw.upgradeToWriting(context.Background(), true)
+	rw.upgraded(start)
+}
+
+//
+// Like UpgradeToWriting, but returns false right away if other readers
+// are still in. The upgradable read is still held if it fails.
+//
+func (rw *ReadWriteLock) TryUpgradeToWriting() bool {
+	start := rw.upgrading()
+	if rw.upgradeToWriting(context.Background(), false) != nil {
+		return false
+	}
+	rw.upgraded(start)
+	return true
+}
+
+//
+// Like UpgradeToWriting, but gives up when ctx is done. The upgradable
+// read is still held and ctx.Err() is returned.
+//
+func (rw *ReadWriteLock) UpgradeToWritingCtx(ctx context.Context) error {
+	start := rw.upgrading()
+	if err := rw.upgradeToWriting(ctx, true); err != nil {
+		return err
+	}
+	rw.upgraded(start)
+	return nil
+}
+
+func (rw *ReadWriteLock) upgrading() time.Time {
+	if rw.checker != nil {
+		rw.checker.holding(false, true)
+	}
+	return time.Now()
+}
+
+func (rw *ReadWriteLock) upgraded(start time.Time) {
+	rw.releasing(false, true)
+	rw.acquired(true, start)
+}
+
+//
+// Waits until ctx is done, or not at all unless wait is set.
+//
+func (rw *ReadWriteLock) upgradeToWriting(ctx context.Context, wait bool) error {
+	acquire := acquireTry
+	if wait {
+		acquire = acquireCtx(ctx)
+	}
+
+	// Hold back new readers, then wait for the current ones to leave
+	switch rw.Policy {
+	case LockPolicyReaderPreferring:
+		return rw.takeOverResource(acquire)
+	case LockPolicyWriterPreferring:
+		if err := rw.joinWriters(acquire); err != nil {
+			return err
+		}
+
+		if err := rw.takeOverResource(acquire); err != nil {
+			rw.leaveWriters()
+			return err
+		}
+		return nil
+	default:
+		turnstile, err := rw.acquireTurnstile(ctx, wait)
+		if err != nil {
+			return err
+		}
+
+		err = rw.takeOverResource(acquire)
+		if turnstile {
+			rw.ServiceQueue.V()
+		} else if err != nil {
+			// Give the waiting writer its token back. If it has given up
+			// meanwhile, the next writer clears it.
+			select {
+			case rw.TurnstileHeld <- Empty{}:
+			default:
+			}
+		}
+		return err
+	}
+}
+
+//
+// Takes ServiceQueue for an upgrade. A writer waiting on UpgradeLock may
+// hold it already, in which case it has left a token in TurnstileHeld,
+// and taking that does instead. Returns true if it took ServiceQueue.
+//
+func (rw *ReadWriteLock) acquireTurnstile(ctx context.Context, wait bool) (bool, error) {
+	if !wait {
+		select {
+		case rw.ServiceQueue <- Empty{}:
+			return true, nil
+		case <-rw.TurnstileHeld:
+			return false, nil
+		default:
+			return false, errWouldBlock
+		}
+	}
+
+	select {
+	case rw.ServiceQueue <- Empty{}:
+		return true, nil
+	case <-rw.TurnstileHeld:
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+//
+// Leaves the readers and takes ResourceLock once the others are gone.
+// If that fails, rejoins them. No writer can have taken ResourceLock in
+// between, since the upgradable reader holds UpgradeLock.
+//
+func (rw *ReadWriteLock) takeOverResource(acquire acquirer) error {
+	rw.unlockReading()
+	if err := acquire(rw.ResourceLock); err != nil {
+		rw.joinReaders(acquireBlocking, false)
+		return err
+	}
+	return nil
+}
+
+type writeLocker struct {
+	rw *ReadWriteLock
+}
+
+func (l writeLocker) Lock() {
+	l.rw.LockForWriting()
+}
+
+func (l writeLocker) Unlock() {
+	l.rw.WritingUnlock()
+}
+
+type readLocker struct {
+	rw *ReadWriteLock
+}
+
+func (l readLocker) Lock() {
+	l.rw.LockForReading()
+}
+
+func (l readLocker) Unlock() {
+	l.rw.ReadingUnlock()
+}
+
+//
+// A sync.Locker that locks for writing, for use with sync.Cond and
+// the like.
+//
+func (rw *ReadWriteLock) Locker() sync.Locker {
+	return writeLocker{rw}
+}
+
+//
+// A sync.Locker that locks for reading.
+//
+func (rw *ReadWriteLock) RLocker() sync.Locker {
+	return readLocker{rw}
+}
+
+type rwMutexLocker struct {
+	m *sync.RWMutex
+}
+
+func (l rwMutexLocker) LockForReading() {
+	l.m.RLock()
+}
+
+func (l rwMutexLocker) ReadingUnlock() {
+	l.m.RUnlock()
+}
+
+func (l rwMutexLocker) LockForWriting() {
+	l.m.Lock()
+}
+
+func (l rwMutexLocker) WritingUnlock() {
+	l.m.Unlock()
+}
+
+//
+// Lets a sync.RWMutex stand in for ReadWriteLock, for example as
+// Hub.Lock.
+//
+func NewRWMutexLocker(m *sync.RWMutex) RWLocker {
+	return rwMutexLocker{m}
 }
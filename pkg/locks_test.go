@@ -3,7 +3,9 @@ package pkg
 
 import (
 	_ "fmt"
+	"context"
 	"strconv"
+	"sync"
 	"time"
 	"testing"
 	"github.com/stretchr/testify/assert"
@@ -225,3 +227,488 @@ func TestReadWriteWriterBlocksWriter(t *testing.T) {
 
 	assert.Equal(t, []string{"hello", "mike", "how are you"}, list)
 }
+
+func TestTryLock(t *testing.T) {
+	lock := &ReadWriteLock{}
+	lock.Init()
+
+	lock.LockForWriting()
+	assert.False(t, lock.TryLockForReading())
+	assert.False(t, lock.TryLockForWriting())
+	assert.Equal(t, 0, lock.ReaderCount)
+	assert.Equal(t, 0, len(lock.ServiceQueue))
+	lock.WritingUnlock()
+
+	assert.True(t, lock.TryLockForReading())
+	assert.True(t, lock.TryLockForReading())
+	assert.Equal(t, 2, lock.ReaderCount)
+	assert.False(t, lock.TryLockForWriting())
+	lock.ReadingUnlock()
+	lock.ReadingUnlock()
+
+	assert.True(t, lock.TryLockForWriting())
+	lock.WritingUnlock()
+}
+
+func TestLockForWritingCtx(t *testing.T) {
+	lock := &ReadWriteLock{}
+	lock.Init()
+
+	lock.LockForReading()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+	err := lock.LockForWritingCtx(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, len(lock.ServiceQueue))
+	assert.Equal(t, 1, lock.ReaderCount)
+
+	// Readers aren't stuck behind the writer that gave up
+	assert.True(t, lock.TryLockForReading())
+	lock.ReadingUnlock()
+	lock.ReadingUnlock()
+
+	assert.Nil(t, lock.LockForWritingCtx(context.Background()))
+	lock.WritingUnlock()
+}
+
+func TestLockForReadingCtx(t *testing.T) {
+	lock := &ReadWriteLock{}
+	lock.Init()
+
+	lock.LockForWriting()
+
+	// Gives up while waiting for the resource
+	ctx, cancel := context.WithCancel(context.Background())
+	g1 := make(chan error)
+	go func() {
+		g1 <- lock.LockForReadingCtx(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-g1)
+	assert.Equal(t, 0, lock.ReaderCount)
+	assert.Equal(t, 0, len(lock.ServiceQueue))
+	assert.Equal(t, 0, len(lock.ReaderCountLock))
+
+	// Gives up while queued behind a waiting writer
+	g2 := make(chan Empty)
+	go func() {
+		lock.LockForWriting()
+		lock.WritingUnlock()
+		g2 <- Em
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, lock.LockForReadingCtx(ctx))
+	assert.Equal(t, 0, lock.ReaderCount)
+
+	lock.WritingUnlock()
+	<-g2
+	assert.Equal(t, 0, len(lock.ServiceQueue))
+
+	assert.Nil(t, lock.LockForReadingCtx(context.Background()))
+	assert.Equal(t, 1, lock.ReaderCount)
+	lock.ReadingUnlock()
+	assert.True(t, lock.TryLockForWriting())
+	lock.WritingUnlock()
+}
+
+func newPolicyLock(policy LockPolicy) *ReadWriteLock {
+	lock := &ReadWriteLock{Policy: policy}
+	lock.Init()
+	return lock
+}
+
+//
+// A reader holds the lock and a writer is waiting. Whether a new reader
+// can join depends on the policy.
+//
+func TestPolicyReaderJoinsWhileWriterWaits(t *testing.T) {
+	expected := map[LockPolicy]bool{
+		LockPolicyFair: false,
+		LockPolicyReaderPreferring: true,
+		LockPolicyWriterPreferring: false,
+	}
+
+	for policy, canJoin := range expected {
+		lock := newPolicyLock(policy)
+		lock.LockForReading()
+
+		g1 := make(chan Empty)
+		go func() {
+			lock.LockForWriting()
+			lock.WritingUnlock()
+			g1 <- Em
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		joined := lock.TryLockForReading()
+		assert.Equal(t, canJoin, joined, "policy %d", policy)
+		if joined {
+			lock.ReadingUnlock()
+		}
+
+		lock.ReadingUnlock()
+		<-g1
+	}
+}
+
+//
+// A writer holds the lock. A reader and then another writer line up.
+//
+func TestPolicyOrderAfterWriter(t *testing.T) {
+	expected := map[LockPolicy]string{
+		LockPolicyFair: "rw",
+		LockPolicyReaderPreferring: "rw",
+		LockPolicyWriterPreferring: "wr",
+	}
+
+	for policy, order := range expected {
+		lock := newPolicyLock(policy)
+		result := ""
+		lock.LockForWriting()
+
+		g1 := make(chan Empty)
+		go func() {
+			lock.LockForReading()
+			result += "r"
+			lock.ReadingUnlock()
+			g1 <- Em
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		g2 := make(chan Empty)
+		go func() {
+			lock.LockForWriting()
+			result += "w"
+			lock.WritingUnlock()
+			g2 <- Em
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		lock.WritingUnlock()
+		<-g1
+		<-g2
+		assert.Equal(t, order, result, "policy %d", policy)
+	}
+}
+
+//
+// A writer holds the lock. Another writer and then a reader line up.
+//
+func TestPolicyOrderWriterThenReader(t *testing.T) {
+	expected := map[LockPolicy]string{
+		LockPolicyFair: "wr",
+		LockPolicyReaderPreferring: "rw",
+		LockPolicyWriterPreferring: "wr",
+	}
+
+	for policy, order := range expected {
+		lock := newPolicyLock(policy)
+		result := ""
+		lock.LockForWriting()
+
+		g1 := make(chan Empty)
+		go func() {
+			lock.LockForWriting()
+			result += "w"
+			lock.WritingUnlock()
+			g1 <- Em
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		g2 := make(chan Empty)
+		go func() {
+			lock.LockForReading()
+			result += "r"
+			lock.ReadingUnlock()
+			g2 <- Em
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		lock.WritingUnlock()
+		<-g1
+		<-g2
+		assert.Equal(t, order, result, "policy %d", policy)
+	}
+}
+
+//
+// Readers hand the lock off to each other and the writer never gets in
+//
+func TestReaderPreferringStarvesWriter(t *testing.T) {
+	lock := newPolicyLock(LockPolicyReaderPreferring)
+	lock.LockForReading()
+
+	writerIn := make(chan Empty, 1)
+	g1 := make(chan Empty)
+	go func() {
+		lock.LockForWriting()
+		writerIn <- Em
+		lock.WritingUnlock()
+		g1 <- Em
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		assert.True(t, lock.TryLockForReading())
+		lock.ReadingUnlock()
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 0, len(writerIn))
+
+	lock.ReadingUnlock()
+	<-g1
+	assert.Equal(t, 1, len(writerIn))
+}
+
+//
+// Writers hand the lock off to each other and the reader never gets in
+//
+func TestWriterPreferringStarvesReader(t *testing.T) {
+	lock := newPolicyLock(LockPolicyWriterPreferring)
+	lock.LockForWriting()
+
+	readerIn := make(chan Empty, 1)
+	g1 := make(chan Empty)
+	go func() {
+		lock.LockForReading()
+		readerIn <- Em
+		lock.ReadingUnlock()
+		g1 <- Em
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		next := make(chan Empty)
+		go func() {
+			lock.LockForWriting()
+			next <- Em
+		}()
+		time.Sleep(time.Millisecond)
+
+		lock.WritingUnlock()
+		<-next
+		assert.Equal(t, 0, len(readerIn))
+	}
+
+	lock.WritingUnlock()
+	<-g1
+	assert.Equal(t, 1, len(readerIn))
+}
+
+func TestWriterPreferringCtx(t *testing.T) {
+	lock := newPolicyLock(LockPolicyWriterPreferring)
+	lock.LockForReading()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, lock.LockForWritingCtx(ctx))
+	assert.Equal(t, 0, lock.WriterCount)
+	assert.Equal(t, 0, len(lock.ServiceQueue))
+
+	// New readers aren't held back by the writer that gave up
+	assert.True(t, lock.TryLockForReading())
+	lock.ReadingUnlock()
+	lock.ReadingUnlock()
+
+	assert.True(t, lock.TryLockForWriting())
+	assert.False(t, lock.TryLockForReading())
+	lock.WritingUnlock()
+	assert.Equal(t, 0, lock.WriterCount)
+	assert.True(t, lock.TryLockForReading())
+	lock.ReadingUnlock()
+}
+
+func TestUpgradableReading(t *testing.T) {
+	for _, policy := range []LockPolicy{LockPolicyFair, LockPolicyReaderPreferring, LockPolicyWriterPreferring} {
+		lock := newPolicyLock(policy)
+		list := []string{"hello"}
+
+		lock.LockForUpgradableReading()
+
+		// Plain readers join, writers and other upgradable readers wait
+		assert.True(t, lock.TryLockForReading(), "policy %d", policy)
+		assert.False(t, lock.TryLockForWriting(), "policy %d", policy)
+
+		secondIn := make(chan Empty, 1)
+		g1 := make(chan Empty)
+		go func() {
+			lock.LockForUpgradableReading()
+			secondIn <- Em
+			assert.Equal(t, []string{"hello", "mike"}, list)
+			lock.UpgradableReadingUnlock()
+			g1 <- Em
+		}()
+
+		// Upgrading waits for the plain reader
+		upgraded := make(chan Empty, 1)
+		g2 := make(chan Empty)
+		go func() {
+			lock.UpgradeToWriting()
+			upgraded <- Em
+			list = append(list, "mike")
+			lock.WritingUnlock()
+			g2 <- Em
+		}()
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 0, len(upgraded), "policy %d", policy)
+		assert.Equal(t, 0, len(secondIn), "policy %d", policy)
+
+		lock.ReadingUnlock()
+		<-g2
+		<-g1
+		assert.Equal(t, 1, len(secondIn), "policy %d", policy)
+
+		assert.True(t, lock.TryLockForWriting(), "policy %d", policy)
+		lock.WritingUnlock()
+	}
+}
+
+//
+// A writer that shows up during an upgradable read goes after the upgrade
+//
+func TestUpgradeBeforeWaitingWriter(t *testing.T) {
+	for _, policy := range []LockPolicy{LockPolicyFair, LockPolicyReaderPreferring, LockPolicyWriterPreferring} {
+		lock := newPolicyLock(policy)
+		total := 1
+
+		lock.LockForUpgradableReading()
+		read := total
+
+		g1 := make(chan Empty)
+		go func() {
+			lock.LockForWriting()
+			total += 100
+			lock.WritingUnlock()
+			g1 <- Em
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		lock.UpgradeToWriting()
+		total = read * 2
+		lock.WritingUnlock()
+		<-g1
+
+		assert.Equal(t, 102, total, "policy %d", policy)
+		assert.Equal(t, 0, lock.WriterCount, "policy %d", policy)
+		assert.True(t, lock.TryLockForReading(), "policy %d", policy)
+		lock.ReadingUnlock()
+	}
+}
+
+func TestTryUpgradeToWriting(t *testing.T) {
+	for _, policy := range []LockPolicy{LockPolicyFair, LockPolicyReaderPreferring, LockPolicyWriterPreferring} {
+		lock := newPolicyLock(policy)
+
+		lock.LockForUpgradableReading()
+		assert.True(t, lock.TryLockForReading(), "policy %d", policy)
+
+		// Still an upgradable reader after failing
+		assert.False(t, lock.TryUpgradeToWriting(), "policy %d", policy)
+		assert.Equal(t, 2, lock.ReaderCount, "policy %d", policy)
+		assert.False(t, lock.TryLockForWriting(), "policy %d", policy)
+
+		lock.ReadingUnlock()
+		assert.True(t, lock.TryUpgradeToWriting(), "policy %d", policy)
+		assert.Equal(t, 0, lock.ReaderCount, "policy %d", policy)
+		assert.False(t, lock.TryLockForReading(), "policy %d", policy)
+		lock.WritingUnlock()
+
+		assert.Equal(t, 0, lock.WriterCount, "policy %d", policy)
+		assert.True(t, lock.TryLockForWriting(), "policy %d", policy)
+		lock.WritingUnlock()
+	}
+}
+
+//
+// A failed upgrade leaves the upgradable read held. A writer that was
+// waiting all along still gets in after it.
+//
+func TestUpgradeToWritingCtx(t *testing.T) {
+	for _, policy := range []LockPolicy{LockPolicyFair, LockPolicyReaderPreferring, LockPolicyWriterPreferring} {
+		lock := newPolicyLock(policy)
+		total := 1
+
+		lock.LockForUpgradableReading()
+		assert.True(t, lock.TryLockForReading(), "policy %d", policy)
+
+		g1 := make(chan Empty)
+		go func() {
+			lock.LockForWriting()
+			total += 100
+			lock.WritingUnlock()
+			g1 <- Em
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+		err := lock.UpgradeToWritingCtx(ctx)
+		cancel()
+		assert.Equal(t, context.DeadlineExceeded, err, "policy %d", policy)
+		assert.Equal(t, 2, lock.ReaderCount, "policy %d", policy)
+
+		// Now it goes through, still ahead of the writer
+		lock.ReadingUnlock()
+		assert.Nil(t, lock.UpgradeToWritingCtx(context.Background()), "policy %d", policy)
+		total *= 2
+		lock.WritingUnlock()
+		<-g1
+
+		assert.Equal(t, 102, total, "policy %d", policy)
+		assert.Equal(t, 0, lock.WriterCount, "policy %d", policy)
+		assert.True(t, lock.TryLockForWriting(), "policy %d", policy)
+		lock.WritingUnlock()
+	}
+}
+
+var _ UpgradableRWLocker = &ReadWriteLock{}
+var _ RWLocker = NewRWMutexLocker(&sync.RWMutex{})
+
+func TestLockerWithCond(t *testing.T) {
+	lock := &ReadWriteLock{}
+	lock.Init()
+	cond := sync.NewCond(lock.Locker())
+	ready := false
+
+	g1 := make(chan Empty)
+	go func() {
+		cond.L.Lock()
+		for !ready {
+			cond.Wait()
+		}
+		cond.L.Unlock()
+		g1 <- Em
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	cond.L.Lock()
+	ready = true
+	cond.Broadcast()
+	cond.L.Unlock()
+	<-g1
+
+	assert.True(t, lock.TryLockForWriting())
+	lock.WritingUnlock()
+}
+
+func TestRLocker(t *testing.T) {
+	lock := &ReadWriteLock{}
+	lock.Init()
+
+	r1 := lock.RLocker()
+	r2 := lock.RLocker()
+	r1.Lock()
+	r2.Lock()
+	assert.Equal(t, 2, lock.ReaderCount)
+	assert.False(t, lock.TryLockForWriting())
+	r1.Unlock()
+	r2.Unlock()
+
+	assert.True(t, lock.TryLockForWriting())
+	assert.False(t, lock.TryLockForReading())
+	lock.Locker().Unlock()
+}
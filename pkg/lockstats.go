@@ -0,0 +1,256 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var histogramBounds = []time.Duration{
+	time.Microsecond,
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+//
+// Counts[i] is how many durations were at most Bounds[i]. The last
+// count is for everything longer.
+//
+type Histogram struct {
+	Bounds []time.Duration      `json:"bounds"`
+	Counts []int                `json:"counts"`
+	Count int                   `json:"count"`
+	Total time.Duration         `json:"total"`
+	Max time.Duration           `json:"max"`
+}
+
+//
+// How long the lock was held from one place in the code.
+//
+type LockSite struct {
+	Site string                 `json:"site"`
+	Count int                   `json:"count"`
+	TotalHold time.Duration     `json:"totalHold"`
+	MaxHold time.Duration       `json:"maxHold"`
+}
+
+type LockStats struct {
+	Reads int                   `json:"reads"`
+	Writes int                  `json:"writes"`
+	ReadWait Histogram          `json:"readWait"`
+	WriteWait Histogram         `json:"writeWait"`
+	ReadHold Histogram          `json:"readHold"`
+	WriteHold Histogram         `json:"writeHold"`
+	PeakReaderCount int         `json:"peakReaderCount"`
+	LongestHolders []LockSite   `json:"longestHolders"`
+}
+
+// How many sites LockStats.LongestHolders lists
+const lockStatsTopSites = 10
+
+type lockHold struct {
+	write bool
+	since time.Time
+	site string
+}
+
+type lockRecorder struct {
+	mu semaphore
+	stats LockStats
+	sites map[string]*LockSite
+
+	// Current holders by goroutine
+	holders map[int64][]lockHold
+}
+
+func newHistogram() Histogram {
+	return Histogram{Bounds: histogramBounds, Counts: make([]int, len(histogramBounds)+1)}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i := sort.Search(len(h.Bounds), func(i int) bool { return d <= h.Bounds[i] })
+	h.Counts[i] += 1
+	h.Count += 1
+	h.Total += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+func (h Histogram) copy() Histogram {
+	h.Counts = append([]int{}, h.Counts...)
+	return h
+}
+
+func newLockRecorder() *lockRecorder {
+	rec := &lockRecorder{mu: make(semaphore, 1), sites: map[string]*LockSite{}, holders: map[int64][]lockHold{}}
+	rec.stats.ReadWait = newHistogram()
+	rec.stats.WriteWait = newHistogram()
+	rec.stats.ReadHold = newHistogram()
+	rec.stats.WriteHold = newHistogram()
+	return rec
+}
+
+//
+// Id of the calling goroutine, from the header of its stack trace.
+//
+func goroutineId() int64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	buf = buf[:bytes.IndexByte(buf, ' ')]
+	id, _ := strconv.ParseInt(string(buf), 10, 64)
+	return id
+}
+
+//
+// Functions that only pass a lock call along, less the package name.
+// callSite looks past them.
+//
+var lockPlumbing = []string{
+	"(*ReadWriteLock).",
+	"writeLocker.",
+	"readLocker.",
+	"(*Hub[...]).lockForUpgradableReading",
+	"(*Hub[...]).upgradableReadingUnlock",
+	"(*Hub[...]).upgradeToWriting",
+}
+
+//
+// Function and line of whoever asked for the lock, past any of
+// lockPlumbing.
+//
+func callSite() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(1, pcs)])
+
+	// The first frame is this function, which gives the package name
+	frame, more := frames.Next()
+	pkgPrefix := strings.TrimSuffix(frame.Function, "callSite")
+	for more {
+		frame, more = frames.Next()
+		if isLockPlumbing(pkgPrefix, frame.Function) {
+			continue
+		}
+
+		if frame.Function != "" {
+			return fmt.Sprintf("%s:%d", frame.Function, frame.Line)
+		}
+		return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+	}
+	return "unknown"
+}
+
+func isLockPlumbing(pkgPrefix string, function string) bool {
+	if !strings.HasPrefix(function, pkgPrefix) {
+		return false
+	}
+
+	for _, plumbing := range lockPlumbing {
+		if strings.HasPrefix(function[len(pkgPrefix):], plumbing) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rec *lockRecorder) acquired(write bool, waited time.Duration, site string) {
+	gid := goroutineId()
+
+	rec.mu.P()
+	if write {
+		rec.stats.Writes += 1
+		rec.stats.WriteWait.observe(waited)
+	} else {
+		rec.stats.Reads += 1
+		rec.stats.ReadWait.observe(waited)
+	}
+	rec.holders[gid] = append(rec.holders[gid], lockHold{write: write, since: time.Now(), site: site})
+	rec.mu.V()
+}
+
+//
+// Called with ReaderCountLock held, right after ReaderCount goes up.
+//
+func (rec *lockRecorder) readers(count int) {
+	rec.mu.P()
+	if count > rec.stats.PeakReaderCount {
+		rec.stats.PeakReaderCount = count
+	}
+	rec.mu.V()
+}
+
+//
+// Unlocks from a goroutine other than the one that locked aren't
+// matched up, so their hold times aren't recorded.
+//
+func (rec *lockRecorder) released(write bool) {
+	gid := goroutineId()
+	now := time.Now()
+
+	rec.mu.P()
+	defer rec.mu.V()
+
+	holds := rec.holders[gid]
+	for i := len(holds) - 1; i >= 0; i-- {
+		if holds[i].write != write {
+			continue
+		}
+
+		held := now.Sub(holds[i].since)
+		if write {
+			rec.stats.WriteHold.observe(held)
+		} else {
+			rec.stats.ReadHold.observe(held)
+		}
+
+		site, ok := rec.sites[holds[i].site]
+		if !ok {
+			site = &LockSite{Site: holds[i].site}
+			rec.sites[holds[i].site] = site
+		}
+		site.Count += 1
+		site.TotalHold += held
+		if held > site.MaxHold {
+			site.MaxHold = held
+		}
+
+		holds = append(holds[:i], holds[i+1:]...)
+		if len(holds) == 0 {
+			delete(rec.holders, gid)
+		} else {
+			rec.holders[gid] = holds
+		}
+		return
+	}
+}
+
+func (rec *lockRecorder) snapshot() LockStats {
+	rec.mu.P()
+	ret := rec.stats
+	ret.ReadWait = rec.stats.ReadWait.copy()
+	ret.WriteWait = rec.stats.WriteWait.copy()
+	ret.ReadHold = rec.stats.ReadHold.copy()
+	ret.WriteHold = rec.stats.WriteHold.copy()
+	ret.LongestHolders = []LockSite{}
+	for _, site := range rec.sites {
+		ret.LongestHolders = append(ret.LongestHolders, *site)
+	}
+	rec.mu.V()
+
+	sort.Slice(ret.LongestHolders, func(i, j int) bool {
+		return ret.LongestHolders[i].MaxHold > ret.LongestHolders[j].MaxHold
+	})
+	if len(ret.LongestHolders) > lockStatsTopSites {
+		ret.LongestHolders = ret.LongestHolders[:lockStatsTopSites]
+	}
+	return ret
+}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func holdForWriting(lock *ReadWriteLock, d time.Duration) {
+	lock.LockForWriting()
+	time.Sleep(d)
+	lock.WritingUnlock()
+}
+
+func TestLockStatsOff(t *testing.T) {
+	lock := &ReadWriteLock{}
+	lock.Init()
+
+	lock.LockForReading()
+	lock.ReadingUnlock()
+
+	_, ok := lock.Stats()
+	assert.False(t, ok)
+}
+
+func TestLockStats(t *testing.T) {
+	lock := &ReadWriteLock{Instrumented: true}
+	lock.Init()
+
+	holdForWriting(lock, 20 * time.Millisecond)
+	lock.LockForWriting()
+	lock.WritingUnlock()
+
+	// Three readers in at once
+	readersIn := make(chan Empty)
+	release := make(chan Empty)
+	done := make(chan Empty)
+	for i := 0; i < 3; i++ {
+		go func() {
+			lock.LockForReading()
+			readersIn <- Em
+			<-release
+			lock.ReadingUnlock()
+			done <- Em
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		<-readersIn
+	}
+
+	// Waits on the readers
+	g1 := make(chan Empty)
+	go func() {
+		holdForWriting(lock, 0)
+		g1 <- Em
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	<-g1
+
+	// Failed attempts aren't counted
+	assert.True(t, lock.TryLockForWriting())
+	assert.False(t, lock.TryLockForWriting())
+	lock.WritingUnlock()
+
+	stats, ok := lock.Stats()
+	assert.True(t, ok)
+	assert.Equal(t, 4, stats.Writes)
+	assert.Equal(t, 3, stats.Reads)
+	assert.Equal(t, 3, stats.PeakReaderCount)
+
+	assert.Equal(t, 4, stats.WriteHold.Count)
+	assert.Equal(t, 3, stats.ReadHold.Count)
+	assert.Equal(t, 3, stats.ReadWait.Count)
+	assert.GreaterOrEqual(t, stats.WriteHold.Max, 20 * time.Millisecond)
+	assert.GreaterOrEqual(t, stats.WriteWait.Max, 10 * time.Millisecond)
+
+	total := 0
+	for _, c := range stats.WriteHold.Counts {
+		total += c
+	}
+	assert.Equal(t, 4, total)
+	assert.Equal(t, len(stats.WriteHold.Bounds) + 1, len(stats.WriteHold.Counts))
+
+	assert.True(t, strings.Contains(stats.LongestHolders[0].Site, "holdForWriting"), stats.LongestHolders[0].Site)
+	assert.GreaterOrEqual(t, stats.LongestHolders[0].MaxHold, 20 * time.Millisecond)
+	assert.Equal(t, 2, stats.LongestHolders[0].Count)
+}
+
+func lockThroughLocker(lock *ReadWriteLock) {
+	locker := lock.Locker()
+	locker.Lock()
+	locker.Unlock()
+}
+
+//
+// Sites name whoever asked for the lock, not the wrappers it went
+// through.
+//
+func TestLockStatsSiteThroughWrappers(t *testing.T) {
+	hub := &Hub[string]{InstrumentLock: true}
+	hub.Init()
+	lock := hub.Lock.(*ReadWriteLock)
+
+	lockThroughLocker(lock)
+
+	_, err := hub.CreateSubscription("job:1")
+	assert.Nil(t, err)
+	assert.Nil(t, hub.removeSubscriber("job:1", "nobody"))
+
+	stats, _ := lock.Stats()
+	sites := []string{}
+	for _, site := range stats.LongestHolders {
+		sites = append(sites, site.Site)
+	}
+	assert.Equal(t, 3, len(sites), sites)
+	for _, expected := range []string{".lockThroughLocker:", ".CreateSubscriptionWithOpts:", ".removeSubscriber:"} {
+		found := false
+		for _, site := range sites {
+			if strings.Contains(site, expected) {
+				found = true
+			}
+		}
+		assert.True(t, found, "%s not in %v", expected, sites)
+	}
+}
@@ -0,0 +1,183 @@
+package pkg
+
+import (
+	"context"
+)
+
+//
+// Holds each goroutine in Await until Parties of them have arrived,
+// then lets them all go and starts over.
+//
+type Barrier struct {
+	Parties int
+
+	// Run by the last goroutine to arrive, before the others are let go.
+	Action func()
+
+	mu semaphore
+	waiters []semaphore
+}
+
+func (b *Barrier) Init() {
+	b.mu = make(semaphore, 1)
+}
+
+func (b *Barrier) Await() {
+	b.mu.P()
+	if len(b.waiters) + 1 < b.Parties {
+		// Full until the last one in empties it
+		waiter := make(semaphore, 1)
+		waiter.P()
+		b.waiters = append(b.waiters, waiter)
+		b.mu.V()
+
+		waiter.P()
+		return
+	}
+
+	// Last one in. Later arrivals start the next round.
+	waiters := b.waiters
+	b.waiters = nil
+	if b.Action != nil {
+		b.Action()
+	}
+	b.mu.V()
+
+	for _, waiter := range waiters {
+		waiter.V()
+	}
+}
+
+//
+// Lets goroutines wait until CountDown has been called Count times.
+// Unlike a Barrier, it can't be reused.
+//
+type CountDownLatch struct {
+	Count int
+
+	mu semaphore
+	waiters []semaphore
+}
+
+func (l *CountDownLatch) Init() {
+	l.mu = make(semaphore, 1)
+}
+
+func (l *CountDownLatch) CountDown() {
+	l.mu.P()
+	if l.Count > 0 {
+		l.Count -= 1
+		if l.Count == 0 {
+			for _, waiter := range l.waiters {
+				waiter.V()
+			}
+			l.waiters = nil
+		}
+	}
+	l.mu.V()
+}
+
+func (l *CountDownLatch) Remaining() int {
+	l.mu.P()
+	ret := l.Count
+	l.mu.V()
+	return ret
+}
+
+//
+// Waits for the count to reach zero, or until ctx is done, in which
+// case ctx.Err() is returned.
+//
+func (l *CountDownLatch) Await(ctx context.Context) error {
+	l.mu.P()
+	if l.Count == 0 {
+		l.mu.V()
+		return nil
+	}
+
+	// Full until CountDown empties it
+	waiter := make(semaphore, 1)
+	waiter.P()
+	l.waiters = append(l.waiters, waiter)
+	l.mu.V()
+
+	err := waiter.pCtx(ctx)
+	if err == nil {
+		return nil
+	}
+
+	l.mu.P()
+	defer l.mu.V()
+	if l.Count == 0 {
+		return nil
+	}
+
+	for i, w := range l.waiters {
+		if w == waiter {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			break
+		}
+	}
+	return err
+}
+
+//
+// Mutual exclusion with named conditions to wait on. Wait, Signal and
+// Broadcast must be called between Enter and Exit. A signalled goroutine
+// gets back in only after the signaller exits, so it should check its
+// condition again.
+//
+type Monitor struct {
+	mu semaphore
+	conditions map[string][]semaphore
+}
+
+func (m *Monitor) Init() {
+	m.mu = make(semaphore, 1)
+	m.conditions = map[string][]semaphore{}
+}
+
+func (m *Monitor) Enter() {
+	m.mu.P()
+}
+
+func (m *Monitor) Exit() {
+	m.mu.V()
+}
+
+//
+// Leaves the monitor until condition is signalled, then enters again.
+//
+func (m *Monitor) Wait(condition string) {
+	waiter := make(semaphore, 1)
+	waiter.P()
+	m.conditions[condition] = append(m.conditions[condition], waiter)
+
+	m.mu.V()
+	waiter.P()
+	m.mu.P()
+}
+
+//
+// Wakes the goroutine that has waited longest on condition, if any.
+//
+func (m *Monitor) Signal(condition string) {
+	waiters := m.conditions[condition]
+	if len(waiters) == 0 {
+		return
+	}
+
+	waiters[0].V()
+	if len(waiters) == 1 {
+		delete(m.conditions, condition)
+	} else {
+		m.conditions[condition] = waiters[1:]
+	}
+}
+
+func (m *Monitor) Broadcast(condition string) {
+	for _, waiter := range m.conditions[condition] {
+		waiter.V()
+	}
+	delete(m.conditions, condition)
+}
@@ -0,0 +1,192 @@
+package pkg
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// Nobody starts round 2 until everyone has finished round 1
+//
+func TestBarrier(t *testing.T) {
+	listLock := make(semaphore, 1)
+	list := []string{}
+	rounds := 0
+
+	barrier := &Barrier{Parties: 3, Action: func() { rounds += 1 }}
+	barrier.Init()
+
+	doneChs := [](chan Empty){}
+	for i := 0; i < 3; i++ {
+		doneCh := make(chan Empty)
+		doneChs = append(doneChs, doneCh)
+		go func(i int) {
+			for round := 1; round <= 2; round++ {
+				// Make some goroutines slower than others
+				time.Sleep(time.Duration(i * 5) * time.Millisecond)
+
+				listLock.P()
+				list = append(list, strconv.Itoa(round))
+				listLock.V()
+
+				barrier.Await()
+			}
+			doneCh <- Em
+		}(i)
+	}
+
+	for _, ch := range doneChs {
+		<-ch
+	}
+
+	assert.Equal(t, []string{"1", "1", "1", "2", "2", "2"}, list)
+	assert.Equal(t, 2, rounds)
+}
+
+func TestBarrierWaitsForAll(t *testing.T) {
+	barrier := &Barrier{Parties: 2}
+	barrier.Init()
+
+	through := make(chan Empty, 1)
+	go func() {
+		barrier.Await()
+		through <- Em
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 0, len(through))
+
+	barrier.Await()
+	<-through
+}
+
+func TestCountDownLatch(t *testing.T) {
+	latch := &CountDownLatch{Count: 3}
+	latch.Init()
+
+	waiters := [](chan error){}
+	for i := 0; i < 2; i++ {
+		waiter := make(chan error, 1)
+		waiters = append(waiters, waiter)
+		go func() {
+			waiter <- latch.Await(context.Background())
+		}()
+	}
+
+	latch.CountDown()
+	latch.CountDown()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, latch.Remaining())
+	for _, waiter := range waiters {
+		assert.Equal(t, 0, len(waiter))
+	}
+
+	latch.CountDown()
+	for _, waiter := range waiters {
+		assert.Nil(t, <-waiter)
+	}
+
+	// Stays open
+	latch.CountDown()
+	assert.Equal(t, 0, latch.Remaining())
+	assert.Nil(t, latch.Await(context.Background()))
+}
+
+func TestCountDownLatchAwaitCtx(t *testing.T) {
+	latch := &CountDownLatch{Count: 1}
+	latch.Init()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, latch.Await(ctx))
+	assert.Empty(t, latch.waiters)
+
+	g1 := make(chan error)
+	go func() {
+		g1 <- latch.Await(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	latch.CountDown()
+	assert.Nil(t, <-g1)
+}
+
+//
+// Bounded buffer, the textbook monitor example
+//
+func TestMonitor(t *testing.T) {
+	monitor := &Monitor{}
+	monitor.Init()
+	buffer := []int{}
+	capacity := 2
+
+	g1 := make(chan Empty)
+	go func() {
+		for i := 0; i < 10; i++ {
+			monitor.Enter()
+			for len(buffer) == capacity {
+				monitor.Wait("notFull")
+			}
+			buffer = append(buffer, i)
+			monitor.Signal("notEmpty")
+			monitor.Exit()
+		}
+		g1 <- Em
+	}()
+
+	result := ""
+	for i := 0; i < 10; i++ {
+		monitor.Enter()
+		for len(buffer) == 0 {
+			monitor.Wait("notEmpty")
+		}
+		assert.LessOrEqual(t, len(buffer), capacity)
+		result = result + strconv.Itoa(buffer[0])
+		buffer = buffer[1:]
+		monitor.Signal("notFull")
+		monitor.Exit()
+
+		if i == 0 {
+			// Let the producer fill up and wait
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	<-g1
+
+	assert.Equal(t, "0123456789", result)
+}
+
+func TestMonitorBroadcast(t *testing.T) {
+	monitor := &Monitor{}
+	monitor.Init()
+	open := false
+
+	doneChs := [](chan Empty){}
+	for i := 0; i < 3; i++ {
+		doneCh := make(chan Empty)
+		doneChs = append(doneChs, doneCh)
+		go func() {
+			monitor.Enter()
+			for !open {
+				monitor.Wait("open")
+			}
+			monitor.Exit()
+			doneCh <- Em
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Nobody is waiting on this one
+	monitor.Enter()
+	monitor.Signal("closed")
+	open = true
+	monitor.Broadcast("open")
+	monitor.Exit()
+
+	for _, ch := range doneChs {
+		<-ch
+	}
+	assert.Empty(t, monitor.conditions)
+}
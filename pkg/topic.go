@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"fmt"
+)
+
+//
+// Typed handle on one subscription of a shared Hub[any], so a single
+// hub can carry job events, presence, logs and so on.
+//
+type Topic[T any] struct {
+	Hub *Hub[any]
+	Name string
+}
+
+//
+// Subscriber side of a Topic.
+//
+type TopicChannel[T any] struct {
+	*HubChannel[any]
+}
+
+func NewTopic[T any](hub *Hub[any], name string) *Topic[T] {
+	return &Topic[T]{Hub: hub, Name: name}
+}
+
+func (t *Topic[T]) Create() error {
+	_, err := t.Hub.CreateSubscription(t.Name)
+	return err
+}
+
+func (t *Topic[T]) CreateWithOpts(opts SubscriptionOpts[T]) error {
+	hubOpts := SubscriptionOpts[any]{Owner: opts.Owner, Labels: opts.Labels, IdleTTL: opts.IdleTTL, MaxPending: opts.MaxPending}
+	if opts.Conflate != nil {
+		hubOpts.Conflate = func(message any) string {
+			if typed, ok := message.(T); ok {
+				return opts.Conflate(typed)
+			}
+			return ""
+		}
+	}
+	_, err := t.Hub.CreateSubscriptionWithOpts(t.Name, hubOpts)
+	return err
+}
+
+func (t *Topic[T]) Remove() error {
+	return t.Hub.RemoveSubscription(t.Name)
+}
+
+func (t *Topic[T]) Publish(message T) error {
+	return t.Hub.PublishTo(t.Name, message)
+}
+
+func (t *Topic[T]) PublishRetained(key string, message T) error {
+	return t.Hub.PublishRetained(t.Name, key, message)
+}
+
+func (t *Topic[T]) Subscribe() (*TopicChannel[T], error) {
+	return t.SubscribeWithOpts(SubscriberOpts[T]{})
+}
+
+func (t *Topic[T]) SubscribeWithOpts(opts SubscriberOpts[T]) (*TopicChannel[T], error) {
+	hubOpts := SubscriberOpts[any]{Meta: opts.Meta, Group: opts.Group}
+	if opts.Filter != nil {
+		hubOpts.Filter = func(message any) bool {
+			typed, ok := message.(T)
+			return ok && opts.Filter(typed)
+		}
+	}
+
+	hCh, err := t.Hub.SubscribeWithOpts(t.Name, hubOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &TopicChannel[T]{hCh}, nil
+}
+
+//
+// Pings for the next message and waits for it. Returns false once the
+// subscription is removed. Messages that aren't a T, which can only come
+// from publishing to the same name outside this Topic, are skipped.
+//
+func (tc *TopicChannel[T]) Receive() (T, bool) {
+	for {
+		tc.ClientPing()
+		m, ok := <-tc.MsgCh
+		if !ok {
+			var zero T
+			return zero, false
+		}
+
+		if typed, ok := m.(T); ok {
+			return typed, true
+		}
+		fmt.Printf("Skipping message of type %T on %s\n", m, tc.LastEnvelope().Subscription)
+	}
+}
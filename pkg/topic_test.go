@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+type logLine struct {
+	Level string
+	Text string
+}
+
+func topicReader[T any](t *testing.T, topic *Topic[T], joined chan<- Empty, received chan<- []T) {
+	cli, err := topic.Subscribe()
+	assert.Nil(t, err)
+
+	joined <- Em
+
+	messages := []T{}
+	for {
+		m, ok := cli.Receive()
+		if !ok {
+			break
+		}
+		messages = append(messages, m)
+	}
+
+	received <- messages
+}
+
+func TestTopicsShareHub(t *testing.T) {
+	hub := &Hub[any]{}
+	hub.Init()
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	jobs := NewTopic[JobStatus](hub, "job:1")
+	logs := NewTopic[logLine](hub, "logs:job:1")
+	assert.Nil(t, jobs.Create())
+	assert.Nil(t, logs.Create())
+
+	joined := make(chan Empty)
+	jobsReceived := make(chan []JobStatus, 1)
+	logsReceived := make(chan []logLine, 1)
+	go topicReader(t, jobs, joined, jobsReceived)
+	<-joined
+	go topicReader(t, logs, joined, logsReceived)
+	<-joined
+
+	assert.Nil(t, jobs.Publish(JobStatus{Type: "complete", Complete: 0.5}))
+	assert.Nil(t, logs.Publish(logLine{Level: "info", Text: "Starting"}))
+	assert.Nil(t, jobs.Publish(JobStatus{Type: "message", Message: "Part 1"}))
+
+	// Wrong type on the same name is skipped by the typed reader
+	assert.Nil(t, hub.PublishTo("logs:job:1", 42))
+	assert.Nil(t, logs.Publish(logLine{Level: "warn", Text: "Slow"}))
+
+	assert.Nil(t, jobs.Remove())
+	assert.Nil(t, logs.Remove())
+
+	assert.Equal(t, []JobStatus{{Type: "complete", Complete: 0.5}, {Type: "message", Message: "Part 1"}}, <-jobsReceived)
+	assert.Equal(t, []logLine{{Level: "info", Text: "Starting"}, {Level: "warn", Text: "Slow"}}, <-logsReceived)
+
+	hub.CommandCh <- HubCommand[any]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestTopicFilter(t *testing.T) {
+	hub := &Hub[any]{}
+	hub.Init()
+
+	g1 := make(chan Empty)
+	go func() {
+		hub.Listen()
+		g1 <- Em
+	}()
+
+	logs := NewTopic[logLine](hub, "logs:job:1")
+	assert.Nil(t, logs.Create())
+
+	cli, err := logs.SubscribeWithOpts(SubscriberOpts[logLine]{Filter: func(l logLine) bool { return l.Level == "warn" }})
+	assert.Nil(t, err)
+
+	received := make(chan []logLine, 1)
+	go func() {
+		messages := []logLine{}
+		for {
+			m, ok := cli.Receive()
+			if !ok {
+				break
+			}
+			messages = append(messages, m)
+		}
+		received <- messages
+	}()
+
+	logs.Publish(logLine{Level: "info", Text: "Starting"})
+	logs.Publish(logLine{Level: "warn", Text: "Slow"})
+	logs.Remove()
+
+	assert.Equal(t, []logLine{{Level: "warn", Text: "Slow"}}, <-received)
+
+	hub.CommandCh <- HubCommand[any]{CmdType: HubCmdShutdown}
+	<-g1
+}
+
+func TestHubArbitraryType(t *testing.T) {
+	hub := &Hub[int]{CommandChSize: 1}
+	hub.Init()
+
+	_, err := hub.CreateSubscription("counter")
+	assert.Nil(t, err)
+	assert.Nil(t, hub.PublishTo("counter", 7))
+
+	cmd := <-hub.CommandCh
+	assert.Equal(t, 7, cmd.Message)
+}
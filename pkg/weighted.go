@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+//
+// Counting semaphore where each holder takes some weight of Size.
+// Waiters are served in the order they arrive, and nobody gets ahead
+// of a large request that is waiting for room.
+//
+type WeightedSemaphore struct {
+	Size int64
+
+	mu semaphore
+	used int64
+	waiters []*weightedWaiter
+}
+
+type weightedWaiter struct {
+	n int64
+	ready chan Empty
+}
+
+func (ws *WeightedSemaphore) Init() {
+	ws.mu = make(semaphore, 1)
+}
+
+//
+// Waits until n can be taken, or until ctx is done, in which case
+// nothing is taken and ctx.Err() is returned.
+//
+func (ws *WeightedSemaphore) Acquire(ctx context.Context, n int64) error {
+	if n > ws.Size {
+		return errors.New(fmt.Sprintf("Requested weight %d is more than the semaphore size %d", n, ws.Size))
+	}
+
+	ws.mu.P()
+	if len(ws.waiters) == 0 && ws.used + n <= ws.Size {
+		ws.used += n
+		ws.mu.V()
+		return nil
+	}
+
+	waiter := &weightedWaiter{n: n, ready: make(chan Empty)}
+	ws.waiters = append(ws.waiters, waiter)
+	ws.mu.V()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	ws.mu.P()
+	select {
+	case <-waiter.ready:
+		// Granted while giving up, so hand it back
+		ws.used -= n
+	default:
+		for i, w := range ws.waiters {
+			if w == waiter {
+				ws.waiters = append(ws.waiters[:i], ws.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	// Whoever was behind this waiter may fit now
+	ws.grant()
+	ws.mu.V()
+	return ctx.Err()
+}
+
+//
+// Takes n if it's available right now and nobody is waiting.
+//
+func (ws *WeightedSemaphore) TryAcquire(n int64) bool {
+	ws.mu.P()
+	ok := len(ws.waiters) == 0 && ws.used + n <= ws.Size
+	if ok {
+		ws.used += n
+	}
+	ws.mu.V()
+	return ok
+}
+
+func (ws *WeightedSemaphore) Release(n int64) {
+	ws.mu.P()
+	ws.used -= n
+	if ws.used < 0 {
+		ws.mu.V()
+		panic("WeightedSemaphore released more than it held")
+	}
+	ws.grant()
+	ws.mu.V()
+}
+
+//
+// Lets waiters in from the front while they fit. Called with mu held.
+//
+func (ws *WeightedSemaphore) grant() {
+	for len(ws.waiters) > 0 {
+		next := ws.waiters[0]
+		if ws.used + next.n > ws.Size {
+			return
+		}
+
+		ws.used += next.n
+		ws.waiters = ws.waiters[1:]
+		close(next.ready)
+	}
+}
@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func addWeighted(t *testing.T, list *[]int, listLock semaphore, ws *WeightedSemaphore, doneCh chan Empty, i int, n int64) {
+	err := ws.Acquire(context.Background(), n)
+	assert.Nil(t, err)
+
+	if i == 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	listLock.P()
+	*list = append(*list, i)
+	listLock.V()
+
+	ws.Release(n)
+	doneCh <- Em
+}
+
+func TestWeightedOrder(t *testing.T) {
+	ws := &WeightedSemaphore{Size: 3}
+	ws.Init()
+	listLock := make(semaphore, 1)
+	list := &[]int{}
+
+	// The first takes everything, so the rest line up behind it and
+	// go one at a time, whatever their weight
+	weights := []int64{3, 3, 1, 3, 2, 3, 1, 3, 2, 3}
+	doneChs := [](chan Empty){}
+	for i := 0; i < 10; i++ {
+		doneCh := make(chan Empty)
+		doneChs = append(doneChs, doneCh)
+		go addWeighted(t, list, listLock, ws, doneCh, i, weights[i])
+		if i < 9 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	for _, ch := range doneChs {
+		<-ch
+	}
+
+	result := ""
+	for _, i := range *list {
+		result = result + strconv.Itoa(i)
+	}
+
+	assert.Equal(t, "0123456789", result)
+}
+
+func TestWeightedLargeRequestNotStarved(t *testing.T) {
+	ws := &WeightedSemaphore{Size: 3}
+	ws.Init()
+
+	assert.True(t, ws.TryAcquire(1))
+
+	large := make(chan Empty)
+	go func() {
+		assert.Nil(t, ws.Acquire(context.Background(), 3))
+		large <- Em
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// There's room for small ones, but they'd keep the large one out
+	assert.False(t, ws.TryAcquire(1))
+
+	small := make(chan Empty)
+	go func() {
+		assert.Nil(t, ws.Acquire(context.Background(), 1))
+		small <- Em
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ws.Release(1)
+	<-large
+	assert.False(t, ws.TryAcquire(1))
+
+	ws.Release(3)
+	<-small
+	assert.True(t, ws.TryAcquire(2))
+	assert.False(t, ws.TryAcquire(1))
+	ws.Release(3)
+}
+
+func TestWeightedAcquireCtx(t *testing.T) {
+	ws := &WeightedSemaphore{Size: 3}
+	ws.Init()
+
+	err := ws.Acquire(context.Background(), 4)
+	assert.Equal(t, errors.New("Requested weight 4 is more than the semaphore size 3"), err)
+
+	assert.Nil(t, ws.Acquire(context.Background(), 2))
+
+	// Gives up at the front of the line, letting the one behind in
+	small := make(chan Empty)
+	ctx, cancel := context.WithCancel(context.Background())
+	g1 := make(chan error)
+	go func() {
+		g1 <- ws.Acquire(ctx, 3)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		assert.Nil(t, ws.Acquire(context.Background(), 1))
+		small <- Em
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-g1)
+	<-small
+
+	assert.False(t, ws.TryAcquire(1))
+	ws.Release(3)
+	assert.True(t, ws.TryAcquire(3))
+	ws.Release(3)
+}